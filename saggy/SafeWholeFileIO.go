@@ -2,6 +2,7 @@ package saggy
 
 import (
 	"errors"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -18,10 +19,23 @@ type SafeWholeFileIO interface {
 	Remove() error
 }
 
+type SafeWholeFileStreamIO interface {
+	SafeWholeFileIO
+
+	// Open the file for reading, without holding it all in memory; the file must exist
+	OpenReader() (io.ReadCloser, error)
+
+	// Open a replacement for the file; it only replaces the entire file once closed
+	OpenWriter() (io.WriteCloser, error)
+}
+
 type SafeWholeFile struct {
 	filename string
 	perms    fs.FileMode
 	flags    int
+
+	// The open lock file holding the advisory lock; nil when not locked
+	lock *os.File
 }
 
 var defaultPermissions = fs.FileMode(0644)
@@ -44,56 +58,238 @@ func NewSafeWholeFile(filename string, flags int, perms fs.FileMode) *SafeWholeF
 }
 
 func (s *SafeWholeFile) Write(data []byte) error {
+	writer, err := s.openWriter()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Abort()
+		return NewSaggyError("Failed to write to temporary file", err)
+	}
+	return writer.Close()
+}
+
+func (s *SafeWholeFile) OpenWriter() (io.WriteCloser, error) {
+	return s.openWriter()
+}
+
+// SafeWholeFileWriter writes to a temporary file alongside the file, and replaces the file with it on Close
+type SafeWholeFileWriter struct {
+	file    *SafeWholeFile
+	tmpfile *os.File
+
+	// Whether the lock was taken for this writer, and so must be released by it
+	locked bool
+	done   bool
+}
+
+func (s *SafeWholeFile) openWriter() (*SafeWholeFileWriter, error) {
 	// Check if the file is openable for writing
 	if s.flags&os.O_WRONLY == 0 && s.flags&os.O_RDWR == 0 {
-		return NewSaggyError("File is not openable for writing", nil)
+		return nil, NewSaggyError("File is not openable for writing", nil)
+	}
+
+	writer := &SafeWholeFileWriter{file: s}
+
+	// Hold the lock until the writer is closed, unless it is already held across a read and write
+	if s.lock == nil && !(s.flags&os.O_CREATE != 0 && s.flags&os.O_EXCL != 0) {
+		if err := s.Lock(); err != nil {
+			return nil, err
+		}
+		writer.locked = true
+	}
+	fail := func(err error) (*SafeWholeFileWriter, error) {
+		writer.Abort()
+		return nil, err
 	}
 
 	// Check if there are file issues beyong not existing
 	stat, err := os.Stat(s.filename)
 	if err != nil && !os.IsNotExist(err) {
-		return NewSaggyError("Failed to stat file", err)
+		return fail(NewSaggyError("Failed to stat file", err))
 	} else if err == nil && stat.IsDir() {
-		return NewSaggyError("File already exists as a directory", nil)
+		return fail(NewSaggyError("File already exists as a directory", nil))
 	}
 
 	// If the file exists, check we aren't trying to exclusively create it
 	if err == nil && s.flags&os.O_CREATE != 0 && s.flags&os.O_EXCL != 0 {
-		return NewSaggyError("File already exists", nil)
+		return fail(NewSaggyError("File already exists", nil))
 	}
 
 	// Ensure parent directories exist
 	dirname := filepath.Dir(s.filename)
 	if err := os.MkdirAll(dirname, 0755); err != nil {
-		return NewSaggyError("Failed to create parent directories", err)
+		return fail(NewSaggyError("Failed to create parent directories", err))
+	}
+
+	// Never loosen the permissions of an existing file
+	perms := s.perms
+	if stat != nil {
+		perms &= stat.Mode().Perm()
 	}
 
 	// Create the temporary file
-	tmpfile, err := safeCreateRelativeTempFile(s.filename, s.perms)
+	tmpfile, err := safeCreateRelativeTempFile(s.filename, perms)
 	if err != nil {
-		return NewSaggyError("Failed to create temporary file", err)
+		return fail(NewSaggyError("Failed to create temporary file", err))
 	}
-	defer os.Remove(tmpfile.Name())
+	writer.tmpfile = tmpfile
 
-	// Write the data to the temporary file
-	if _, err := tmpfile.Write(data); err != nil {
-		return NewSaggyError("Failed to write to temporary file", err)
+	// The umask may have loosened or tightened the permissions on creation
+	if err := tmpfile.Chmod(perms); err != nil {
+		return fail(NewSaggyError("Failed to set temporary file permissions", err))
+	}
+	if stat != nil {
+		preserveOwnership(tmpfile, stat)
+	}
+
+	return writer, nil
+}
+
+func (w *SafeWholeFileWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, os.ErrClosed
+	}
+	return w.tmpfile.Write(p)
+}
+
+// Close replaces the file with everything written, making sure it reaches the disk first
+func (w *SafeWholeFileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	tmpfile := w.tmpfile
+	defer w.Abort()
+
+	if err := tmpfile.Sync(); err != nil {
+		return NewSaggyError("Failed to sync temporary file", err)
 	}
 	if err := tmpfile.Close(); err != nil {
 		return NewSaggyError("Failed to close temporary file", err)
 	}
 
 	// Rename the temporary file to the target file
-	if err := os.Rename(tmpfile.Name(), s.filename); err != nil {
+	if err := os.Rename(tmpfile.Name(), w.file.filename); err != nil {
 		return NewSaggyError("Failed to rename temporary file", err)
 	}
 
+	// Make sure the rename itself reaches the disk
+	if err := syncDir(filepath.Dir(w.file.filename)); err != nil {
+		return NewSaggyError("Failed to sync directory", err)
+	}
+
+	return nil
+}
+
+// Abort discards everything written, leaving the file untouched
+func (w *SafeWholeFileWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.tmpfile != nil {
+		w.tmpfile.Close()
+		os.Remove(w.tmpfile.Name())
+	}
+	if w.locked {
+		return w.file.Unlock()
+	}
+	return nil
+}
+
+func (s *SafeWholeFile) OpenReader() (io.ReadCloser, error) {
+	// Check if the file is openable for reading
+	if s.flags&os.O_WRONLY != 0 {
+		return nil, NewSaggyError("File is not openable for reading", nil)
+	}
+
+	// Unlike Read, a missing file is an error; there is no stream to read
+	file, err := os.Open(s.filename)
+	if err != nil {
+		return nil, NewSaggyErrorWithMeta("Failed to open file", err, struct{ Path string }{Path: s.filename})
+	}
+
+	if stat, err := file.Stat(); err != nil {
+		file.Close()
+		return nil, NewSaggyError("Failed to stat file", err)
+	} else if stat.IsDir() {
+		file.Close()
+		return nil, NewSaggyError("File already exists as a directory", nil)
+	}
+
+	return file, nil
+}
+
+// lockFilename is the file alongside the file that Lock holds the lock on
+//
+// Locking the file itself would keep it open while its replacement is renamed over it, which windows refuses.
+func (s *SafeWholeFile) lockFilename() string {
+	return s.filename + ".lock"
+}
+
+// Lock takes an advisory lock on the file, blocking until any other holder releases it
+//
+// Hold the lock across a Read and a Write to stop concurrent updates from losing each other's changes.
+// The lock is held on a separate <file>.lock, which is created for the purpose and removed again by Unlock.
+func (s *SafeWholeFile) Lock() error {
+	if s.lock != nil {
+		return NewSaggyError("File is already locked", nil)
+	}
+
+	lockname := s.lockFilename()
+	for {
+		if err := os.MkdirAll(filepath.Dir(lockname), 0755); err != nil {
+			return NewSaggyError("Failed to create parent directories", err)
+		}
+		file, err := os.OpenFile(lockname, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return NewSaggyErrorWithMeta("Failed to open lock file", err, struct{ Path string }{Path: lockname})
+		}
+
+		if err := lockFile(file); err != nil {
+			file.Close()
+			return NewSaggyError("Failed to lock file", err)
+		}
+
+		// The holder before may have removed the lock file while this was waiting for it, in which case the lock is on the old one
+		locked, lockedErr := file.Stat()
+		current, currentErr := os.Stat(lockname)
+		if lockedErr == nil && currentErr == nil && os.SameFile(locked, current) {
+			s.lock = file
+			return nil
+		}
+		unlockFile(file)
+		file.Close()
+	}
+}
+
+// Unlock releases the lock taken by Lock, removing the lock file
+func (s *SafeWholeFile) Unlock() error {
+	if s.lock == nil {
+		return nil
+	}
+	lock := s.lock
+	s.lock = nil
+
+	// Removed while still held, so that anyone waiting on it sees that it was removed and tries again
+	removed := os.Remove(s.lockFilename()) == nil
+
+	if err := unlockFile(lock); err != nil {
+		lock.Close()
+		return NewSaggyError("Failed to unlock file", err)
+	}
+	if err := lock.Close(); err != nil {
+		return NewSaggyError("Failed to close lock file", err)
+	}
+	if !removed {
+		removeClosedLockFile(s.lockFilename())
+	}
 	return nil
 }
 
 func (s *SafeWholeFile) Read() ([]byte, error) {
 	// Check if the file is openable for reading
-	if s.flags&os.O_RDONLY == 0 && s.flags&os.O_RDWR == 0 {
+	if s.flags&os.O_WRONLY != 0 {
 		return nil, NewSaggyError("File is not openable for reading", nil)
 	}
 
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package saggy
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// The lock file is removed while still held; should that fail it is left, rather than removed from under the next holder
+func removeClosedLockFile(lockname string) {}
+
+// preserveOwnership gives the file the same owner and group as the existing one, where permitted
+func preserveOwnership(file *os.File, existing fs.FileInfo) {
+	if stat, ok := existing.Sys().(*syscall.Stat_t); ok {
+		file.Chown(int(stat.Uid), int(stat.Gid))
+	}
+}
+
+// syncDir flushes the directory entry changes, such as a rename, to disk
+func syncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
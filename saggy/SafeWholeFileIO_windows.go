@@ -0,0 +1,37 @@
+//go:build windows
+
+package saggy
+
+import (
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// The whole of the file is locked, which LockFileEx takes as a length of 2^64-1 bytes
+const lockLength = ^uint32(0)
+
+func lockFile(file *os.File) error {
+	overlapped := &windows.Overlapped{}
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, lockLength, lockLength, overlapped)
+}
+
+func unlockFile(file *os.File) error {
+	overlapped := &windows.Overlapped{}
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, lockLength, lockLength, overlapped)
+}
+
+// removeClosedLockFile removes a lock file once closed, as windows refuses to remove a file that is open
+// If another process has opened it meanwhile to wait on the lock, this fails and the file is left for it
+func removeClosedLockFile(lockname string) {
+	os.Remove(lockname)
+}
+
+// Windows ownership is not carried by the file mode, so there is nothing to preserve
+func preserveOwnership(file *os.File, existing fs.FileInfo) {}
+
+// Windows cannot sync a directory; renames are flushed by the filesystem
+func syncDir(dirname string) error {
+	return nil
+}
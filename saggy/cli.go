@@ -5,20 +5,15 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var (
 	useBundledDependencies = getEnv("SAGGY_USE_BUNDLED_DEPENDENCIES", "false") == "true"
+	requireEndorsements    = getEnv("SAGGY_REQUIRE_ENDORSEMENTS", "false") == "true"
 )
 
 func CLI(argv []string) error {
-	var (
-		secretsDir     = getEnv("SAGGY_SECRETS_DIR", "./secrets")
-		privateKeyFile = getEnv("SAGGY_KEY_FILE", filepath.Join(secretsDir, "age.key"))
-		publicKeysFile = getEnv("SAGGY_PUBLIC_KEYS_FILE", filepath.Join(secretsDir, "public-age-keys.json"))
-		keyName        = getEnv("SAGGY_KEYNAME", strings.ToLower(getHostname()))
-	)
-
 	if len(argv) < 2 {
 		fmt.Fprintln(os.Stderr, USAGE_TEXT)
 		return NewCLIError(1, "No command provided", nil, false)
@@ -27,51 +22,156 @@ func CLI(argv []string) error {
 	cmd := argv[1]
 	args := argv[2:]
 
+	// Commands which touch no secrets are run before the config file is read, so that a broken one cannot stop them
 	switch cmd {
-	case "encrypt":
+	case "version":
+		fmt.Println(Version)
+		return nil
 
-		if len(args) < 1 {
+	case "license":
+		if len(args) >= 1 && args[0] == "--full" {
+			fmt.Println(LICENSE_TEXT_FULL)
+		} else {
+			fmt.Println(LICENSE_TEXT)
+		}
+		return nil
+	}
+
+	config, err := FindConfig()
+	if err != nil {
+		return err
+	}
+	if _, set := os.LookupEnv("SAGGY_USE_BUNDLED_DEPENDENCIES"); !set && config.BundledDependencies != nil {
+		useBundledDependencies = *config.BundledDependencies
+	}
+
+	var (
+		secretsDir      = getEnv("SAGGY_SECRETS_DIR", config.secretsDir())
+		privateKeyFiles = filepath.SplitList(getEnv("SAGGY_KEY_FILE", config.keyFiles(secretsDir)))
+		publicKeysFile  = getEnv("SAGGY_PUBLIC_KEYS_FILE", config.publicKeysFile(secretsDir))
+		keyName         = getEnv("SAGGY_KEYNAME", config.keyName())
+		tmpDir          = getEnv("SAGGY_TMPDIR", config.tmpDir())
+	)
+
+	// Once a signed public keys file has been seen with this host's keys, unendorsed keys are always refused
+	if trustRecorded(privateKeyFiles) {
+		requireEndorsements = true
+	}
+
+	switch cmd {
+	case "encrypt":
+		positional, inputType, outputType, err := parsePipeArgs(args)
+		if err != nil {
+			return err
+		}
+		if len(positional) < 1 {
 			return NewCLIError(1, "Nothing provided to encrypt", nil, true)
 		}
-		source := args[0]
+		source := positional[0]
 		destination := ""
-		if len(args) > 1 {
-			destination = args[1]
+		if len(positional) > 1 {
+			destination = positional[1]
 		}
 
-		if encryptKeys, err := EncryptKeysFromFile(publicKeysFile); err != nil {
+		encryptKeys, err := EncryptKeysFromFileTrusting(publicKeysFile, func() (*DecryptKey, error) {
+			return DecryptKeysFromFiles(privateKeyFiles)
+		})
+		if err != nil {
+			return err
+		}
+		if err := encryptKeys.useRules(config.recipientRules()); err != nil {
 			return err
-		} else {
-			return Encrypt(encryptKeys, source, destination)
 		}
 
+		if source == "-" || destination == "-" || inputType != "" || outputType != "" {
+			// Plaintext from stdin has no name to derive a destination from, so it goes to stdout
+			if destination == "" && source == "-" {
+				destination = "-"
+			} else if destination == "" {
+				destination = getSopsifiedFilename(source)
+			}
+			format, err := pipeFormat(source, destination, inputType, outputType)
+			if err != nil {
+				return err
+			}
+			return EncryptPipe(encryptKeys, source, destination, format)
+		}
+		return Encrypt(encryptKeys, source, destination)
+
 	case "decrypt":
-		if len(args) < 1 {
+		args, identities := parseIdentityArgs(args)
+		positional, inputType, outputType, err := parsePipeArgs(args)
+		if err != nil {
+			return err
+		}
+		if len(positional) < 1 {
 			return NewCLIError(1, "Nothing provided to decrypt", nil, true)
 		}
-		source := args[0]
+		source := positional[0]
 		destination := ""
-		if len(args) > 1 {
-			destination = args[1]
+		if len(positional) > 1 {
+			destination = positional[1]
 		}
 
-		if decryptKey, err := DecryptKeysFromFile(privateKeyFile); err != nil {
+		decryptKey, err := DecryptKeysFromFiles(withIdentities(privateKeyFiles, identities))
+		if err != nil {
 			return err
-		} else {
-			return Decrypt(decryptKey, source, destination)
 		}
 
+		if source == "-" || destination == "-" || inputType != "" || outputType != "" {
+			if destination == "" && source == "-" {
+				destination = "-"
+			} else if destination == "" {
+				destination = unsopsifyFilename(source)
+			}
+			format, err := pipeFormat(source, destination, inputType, outputType)
+			if err != nil {
+				return err
+			}
+			return DecryptPipe(decryptKey, source, destination, format)
+		}
+		return Decrypt(decryptKey, source, destination)
+
 	case "keygen":
-		if len(args) > 0 {
-			if args[0] == "-" {
-				return KeyGen_parameterised(&KeyGenParameters{
-					privateKeyWriter: os.Stdout,
-					privateKeyFormat: "age",
-				})
+		args, keyInfo, err := parseKeyInfoArgs(args)
+		if err != nil {
+			return err
+		}
+		toStdout := false
+		passphrase := ""
+		sshKeyFile := ""
+		for i := 0; i < len(args); i++ {
+			switch {
+			case args[i] == "-":
+				toStdout = true
+			case args[i] == "--passphrase":
+				var err error
+				if passphrase, err = readPassphrase("Enter a passphrase for the new key: ", true); err != nil {
+					return err
+				}
+			case args[i] == "--ssh" && i+1 < len(args):
+				sshKeyFile = args[i+1]
+				i++
+			default:
+				return NewCLIError(1, "Unexpected argument: "+args[i], nil, true)
 			}
 		}
+		if sshKeyFile != "" && (toStdout || passphrase != "") {
+			return NewCLIError(1, "An imported SSH key cannot be written to stdout or given a passphrase", nil, true)
+		}
+		if toStdout {
+			return KeyGen_parameterised(&KeyGenParameters{
+				privateKeyWriter: os.Stdout,
+				privateKeyFormat: "age",
+				passphrase:       passphrase,
+			})
+		}
 
-		privateKeyFileAbs, err := filepath.Abs(privateKeyFile)
+		// Only the first key file is written to
+		if len(privateKeyFiles) == 0 {
+			return NewCLIError(1, "No private key file configured; SAGGY_KEY_FILE is empty", nil, false)
+		}
+		privateKeyFileAbs, err := filepath.Abs(privateKeyFiles[0])
 		if err != nil {
 			return err
 		}
@@ -87,41 +187,372 @@ func CLI(argv []string) error {
 			keyName:            keyName,
 			privateKeyFormat:   "age",
 			publicKeysFormat:   "json",
+			passphrase:         passphrase,
+			sshKeyFilepath:     sshKeyFile,
+			keyInfo:            keyInfo,
 		})
 
 	case "with":
-		if len(args) < 2 {
-			return NewCLIError(1, "Usage: with <target> [-w] -- <command>", nil, true)
+		parameters := &WithParameters{mode: "read", tmpDir: tmpDir}
+		identities := []string{}
+		separator := -1
+		for i := 0; i < len(args); i++ {
+			arg := args[i]
+			if arg == "--" {
+				separator = i
+				break
+			}
+			switch {
+			case arg == "-w":
+				parameters.mode = "write"
+			case arg == "-e":
+				parameters.mode = "env"
+			case arg == "--shell":
+				parameters.shell = "sh"
+				// The shell path is optional, so it is only taken once the target is known, and never when it looks like a flag
+				if (parameters.target != "" || len(parameters.secrets) > 0) && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+					parameters.shell = args[i+1]
+					i++
+				}
+			case strings.HasPrefix(arg, "--shell="):
+				parameters.shell = strings.TrimPrefix(arg, "--shell=")
+			case arg == "--allow-disk":
+				parameters.allowDisk = true
+			case arg == "--fifo":
+				parameters.fifo = true
+			case arg == "--fifo-timeout" && i+1 < len(args):
+				timeout, err := time.ParseDuration(args[i+1])
+				if err != nil || timeout <= 0 {
+					return NewCLIError(1, "Invalid FIFO timeout: "+args[i+1], err, true)
+				}
+				parameters.fifoTimeout = timeout
+				i++
+			case arg == "--identity" && i+1 < len(args):
+				identities = append(identities, args[i+1])
+				i++
+			case strings.HasPrefix(arg, "--identity="):
+				identities = append(identities, strings.TrimPrefix(arg, "--identity="))
+			case arg == "-I" && i+1 < len(args):
+				parameters.token = args[i+1]
+				i++
+			case arg == "--secret" && i+1 < len(args):
+				secret, err := ParseWithSecret(args[i+1])
+				if err != nil {
+					return err
+				}
+				parameters.secrets = append(parameters.secrets, secret)
+				i++
+			case arg == "--prefix" && i+1 < len(args):
+				parameters.envPrefix = args[i+1]
+				i++
+			case parameters.target == "":
+				parameters.target = arg
+			default:
+				return NewCLIError(1, "Unexpected argument: "+arg, nil, true)
+			}
 		}
-		target := args[0]
-		mode := "read"
-		commandIndex := 1
-		if args[1] == "-w" {
-			mode = "write"
-			commandIndex = 2
+		if (parameters.target == "" && len(parameters.secrets) == 0) || separator == -1 {
+			return NewCLIError(1, "Usage: with [target] [-I <token>] [--secret NAME=<path>]... [-w|-e [--prefix <prefix>]] [--shell [path]] [--allow-disk] [--fifo [--fifo-timeout <duration>]] [--identity <key file>]... -- <command>", nil, true)
 		}
-		command := args[commandIndex+1:]
+		parameters.command = args[separator+1:]
 
-		keys, err := KeysFromFiles(publicKeysFile, privateKeyFile)
+		keys, err := KeysFromFiles(publicKeysFile, withIdentities(privateKeyFiles, identities)...)
 		if err != nil {
 			return err
 		}
+		if err := keys.EncryptKeys.useRules(config.recipientRules()); err != nil {
+			return err
+		}
 
-		return With(keys, target, command, mode)
+		return With(keys, parameters)
 
-	case "version":
-		fmt.Println(Version)
+	case "env":
+		separator := -1
+		for i, arg := range args {
+			if arg == "--" {
+				separator = i
+				break
+			}
+		}
+		if separator < 1 || separator == len(args)-1 {
+			return NewCLIError(1, "Usage: env <varname>=<secret path>[#key]... -- <command>", nil, true)
+		}
+
+		decryptKey, err := DecryptKeysFromFiles(privateKeyFiles)
+		if err != nil {
+			return err
+		}
+
+		return Env(&Keys{DecryptKey: decryptKey}, args[:separator], args[separator+1:])
+
+	case "rotate":
+		if len(args) < 1 {
+			return NewCLIError(1, "Nothing provided to rotate", nil, true)
+		}
+
+		keys, err := KeysFromFiles(publicKeysFile, privateKeyFiles...)
+		if err != nil {
+			return err
+		}
+		if err := keys.EncryptKeys.useRules(config.recipientRules()); err != nil {
+			return err
+		}
+
+		result, err := Rotate(keys, keyName, args)
+		if err != nil {
+			return err
+		}
+		if result.NeedsEndorsing {
+			fmt.Fprintln(os.Stderr, "Rotated "+result.KeyName+"; its old entry had no signing key to vouch for the new one, so it needs endorsing again with saggy keys endorse "+result.KeyName)
+		}
 		return nil
 
-	case "license":
-		if len(args) >= 1 && args[0] == "--full" {
-			fmt.Println(LICENSE_TEXT_FULL)
+	case "updatekeys":
+		dryRun := false
+		targets := []string{}
+		for _, arg := range args {
+			if arg == "--dry-run" {
+				dryRun = true
+			} else {
+				targets = append(targets, arg)
+			}
+		}
+		if len(targets) < 1 {
+			return NewCLIError(1, "Nothing provided to update", nil, true)
+		}
+
+		// A dry run encrypts nothing, so has no need to know which keys are endorsed
+		keys := &Keys{}
+		var trustFrom func() (*DecryptKey, error)
+		if !dryRun {
+			if decryptKey, err := DecryptKeysFromFiles(privateKeyFiles); err != nil {
+				return err
+			} else {
+				keys.DecryptKey = decryptKey
+			}
+			trustFrom = func() (*DecryptKey, error) {
+				return keys.DecryptKey, nil
+			}
+		}
+		if encryptKeys, err := EncryptKeysFromFileTrusting(publicKeysFile, trustFrom); err != nil {
+			return err
+		} else if err := encryptKeys.useRules(config.recipientRules()); err != nil {
+			return err
 		} else {
-			fmt.Println(LICENSE_TEXT)
+			keys.EncryptKeys = encryptKeys
+		}
+
+		results, err := UpdateKeys(keys, targets, dryRun)
+		printUpdateKeysResults(os.Stdout, keys.EncryptKeys, results, dryRun)
+		return err
+
+	case "revoke":
+		if len(args) < 1 {
+			return NewCLIError(1, "No key name provided to revoke", nil, true)
+		}
+		if len(args) < 2 {
+			return NewCLIError(1, "Nothing provided to re-encrypt", nil, true)
+		}
+
+		keys, err := KeysFromFiles(publicKeysFile, privateKeyFiles...)
+		if err != nil {
+			return err
+		}
+		if err := keys.EncryptKeys.useRules(config.recipientRules()); err != nil {
+			return err
+		}
+
+		result, err := Revoke(keys, args[0], args[1:])
+		printRevokeResult(os.Stdout, result)
+		return err
+
+	case "check":
+		targets := args
+		if len(targets) == 0 {
+			// Default to everything the rules could cover
+			targets = []string{"."}
+			if rules := config.recipientRules(); rules != nil {
+				targets = []string{rules.dir}
+				if cwd, err := os.Getwd(); err == nil {
+					if relDir, err := filepath.Rel(cwd, rules.dir); err == nil {
+						targets = []string{relDir}
+					}
+				}
+			}
+		}
+
+		encryptKeys, err := EncryptKeysFromFile(publicKeysFile)
+		if err != nil {
+			return err
+		}
+		if err := encryptKeys.useRules(config.recipientRules()); err != nil {
+			return err
+		}
+
+		results, err := Check(encryptKeys, targets)
+		printCheckResults(os.Stdout, encryptKeys, results)
+		return err
+
+	case "keys":
+		if len(args) < 1 {
+			return NewCLIError(1, "Usage: keys list|show [name]|add <name> <public key>|remove <name>|endorse <name>", nil, true)
+		}
+		switch {
+		case args[0] == "list" && len(args) == 1:
+			entries, err := ListKeys(publicKeysFile)
+			if err != nil {
+				return err
+			}
+			printKeysList(os.Stdout, entries)
+			return nil
+
+		case args[0] == "show" && len(args) <= 2:
+			entries, err := ListKeys(publicKeysFile)
+			if err != nil {
+				return err
+			}
+			names := sortedKeys(entries)
+			if len(args) == 2 {
+				if _, ok := entries[args[1]]; !ok {
+					return NewSaggyErrorWithMeta("No such key in the public keys file", nil, struct{ KeyName string }{KeyName: args[1]})
+				}
+				names = []string{args[1]}
+			}
+			printKeyDetails(os.Stdout, entries, names)
+			return nil
+
+		case args[0] == "add":
+			rest, keyInfo, err := parseKeyInfoArgs(args[1:])
+			if err != nil {
+				return err
+			}
+			if len(rest) != 2 {
+				return NewCLIError(1, "Usage: keys add <name> <public key> [--owner <name>] [--comment <text>] [--type <type>] [--group <group>]... [--expires <date>]", nil, true)
+			}
+			if err := AddKey(publicKeysFile, rest[0], rest[1], keyInfo); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Added "+rest[0]+"; run saggy updatekeys to encrypt existing secrets for it")
+			return nil
+
+		case args[0] == "remove" && len(args) == 2:
+			if _, err := RemoveKey(publicKeysFile, args[1], config.recipientRules()); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Removed "+args[1]+"; existing secrets are still readable with it until they are re-encrypted, which saggy revoke does")
+			return nil
+
+		case args[0] == "endorse" && len(args) == 2:
+			decryptKey, err := DecryptKeysFromFiles(privateKeyFiles)
+			if err != nil {
+				return err
+			}
+			result, err := Endorse(publicKeysFile, decryptKey, args[1])
+			if err != nil {
+				return err
+			}
+			printEndorseResult(os.Stdout, result)
+			if result.SigningKeyAdded {
+				fmt.Fprintln(os.Stderr, "Added the signing key of "+result.EndorsedBy+"; any endorsements of it need making again")
+			}
+			return nil
+
+		default:
+			return NewCLIError(1, "Usage: keys list|show [name]|add <name> <public key>|remove <name>|endorse <name>", nil, true)
 		}
-		return nil
 
 	default:
 		return NewCLIError(1, "Unknown command: "+cmd, nil, true)
 	}
 }
+
+// parsePipeArgs separates --input-type and --output-type from the positional arguments of encrypt and decrypt
+func parsePipeArgs(args []string) ([]string, string, string, error) {
+	positional := []string{}
+	inputType := ""
+	outputType := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--input-type" && i+1 < len(args):
+			inputType = args[i+1]
+			i++
+		case args[i] == "--output-type" && i+1 < len(args):
+			outputType = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--input-type="):
+			inputType = strings.TrimPrefix(args[i], "--input-type=")
+		case strings.HasPrefix(args[i], "--output-type="):
+			outputType = strings.TrimPrefix(args[i], "--output-type=")
+		case len(positional) < 2:
+			positional = append(positional, args[i])
+		default:
+			return nil, "", "", NewCLIError(1, "Unexpected argument: "+args[i], nil, true)
+		}
+	}
+	return positional, inputType, outputType, nil
+}
+
+// parseIdentityArgs separates each --identity <key file> from the rest of the arguments
+func parseIdentityArgs(args []string) ([]string, []string) {
+	rest := []string{}
+	identities := []string{}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--identity" && i+1 < len(args):
+			identities = append(identities, args[i+1])
+			i++
+		case strings.HasPrefix(args[i], "--identity="):
+			identities = append(identities, strings.TrimPrefix(args[i], "--identity="))
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return rest, identities
+}
+
+// withIdentities appends the key files given with --identity to the configured ones
+//
+// A single configured key file which does not exist is dropped, so that an identity can be used on its own.
+func withIdentities(privateKeyFiles []string, identities []string) []string {
+	if len(identities) == 0 {
+		return privateKeyFiles
+	}
+	if len(privateKeyFiles) == 1 {
+		if _, err := os.Stat(privateKeyFiles[0]); os.IsNotExist(err) {
+			privateKeyFiles = nil
+		}
+	}
+	return append(append([]string{}, privateKeyFiles...), identities...)
+}
+
+// parseKeyInfoArgs separates what is recorded about a key, such as --owner, from the rest of the arguments
+func parseKeyInfoArgs(args []string) ([]string, *PublicKeyEntry, error) {
+	rest := []string{}
+	keyInfo := &PublicKeyEntry{}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--owner" && i+1 < len(args):
+			keyInfo.Owner = args[i+1]
+			i++
+		case args[i] == "--comment" && i+1 < len(args):
+			keyInfo.Comment = args[i+1]
+			i++
+		case args[i] == "--type" && i+1 < len(args):
+			keyInfo.Type = args[i+1]
+			i++
+		case args[i] == "--group" && i+1 < len(args):
+			keyInfo.Groups = append(keyInfo.Groups, args[i+1])
+			i++
+		case args[i] == "--expires" && i+1 < len(args):
+			expires, err := normaliseKeyDate(args[i+1])
+			if err != nil {
+				return nil, nil, NewCLIError(1, "Invalid expiry date: "+args[i+1], err, true)
+			}
+			keyInfo.Expires = expires
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return rest, keyInfo, nil
+}
@@ -0,0 +1,193 @@
+package saggy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are looked for in the current directory and each of its parents, in this order
+var configFileNames = []string{".saggy.yaml", ".saggy.yml"}
+
+// Config is the project configuration read from a .saggy.yaml file
+//
+// Every setting is optional, and the matching environment variable always takes precedence over it.
+// Relative paths are resolved against the directory holding the config file, rather than the current directory.
+type Config struct {
+	// The directory containing the secrets
+	// Optional; defaults to secrets alongside the config file
+	SecretsDir string `yaml:"secretsDir"`
+
+	// The files containing private keys, tried in turn when decrypting; the first is written to by keygen
+	// Optional; defaults to age.key in the secrets directory
+	KeyFiles stringList `yaml:"keyFile"`
+
+	// The json file containing the public keys
+	// Optional; defaults to public-age-keys.json in the secrets directory
+	PublicKeysFile string `yaml:"publicKeysFile"`
+
+	// How keys are named when added by keygen; {hostname} and {user} are replaced
+	// Optional; defaults to {hostname}
+	KeyName string `yaml:"keyName"`
+
+	// Where with puts decrypted files
+	// Optional; if not provided a memory backed location is found
+	TmpDir string `yaml:"tmpDir"`
+
+	// Whether to use the bundled age and sops rather than the installed binaries
+	// Optional; defaults to false
+	BundledDependencies *bool `yaml:"bundledDependencies"`
+
+	// Named sets of key names, which rules can refer to in place of the keys themselves
+	// Optional
+	Groups map[string][]string `yaml:"groups"`
+
+	// Which keys the secrets under each path are encrypted for; the first matching rule is used
+	// Optional; if not provided every file is encrypted for every key
+	Rules []*RecipientRule `yaml:"rules"`
+
+	// The config file that was read; empty if none was found
+	path string
+}
+
+// stringList accepts either a single string or a list of strings
+type stringList []string
+
+func (list *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*list = stringList{node.Value}
+		return nil
+	}
+	return node.Decode((*[]string)(list))
+}
+
+// FindConfig reads the config file named by SAGGY_CONFIG, or else the first found walking up from the current directory
+//
+// If there is no config file an empty config is returned, and everything is relative to the current directory.
+func FindConfig() (*Config, error) {
+	if path := getEnv("SAGGY_CONFIG", ""); path != "" {
+		return ReadConfig(path)
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, NewSaggyError("Failed to get the current directory", err)
+	}
+	for {
+		for _, name := range configFileNames {
+			path := filepath.Join(dir, name)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return ReadConfig(path)
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return &Config{}, nil
+		}
+		dir = parent
+	}
+}
+
+// ReadConfig reads a config file, rejecting any setting it does not recognise
+func ReadConfig(path string) (*Config, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, NewSaggyErrorWithMeta("Failed to resolve the config file", err, struct{ Path string }{Path: path})
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, NewSaggyErrorWithMeta("Failed to read the config file", err, struct{ Path string }{Path: path})
+	}
+
+	config := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, NewSaggyErrorWithMeta("Failed to parse the config file", err, struct{ Path string }{Path: path})
+	}
+	config.path = path
+
+	return config, nil
+}
+
+// resolve makes a path from the config file relative to the directory holding it, expanding a leading ~
+func (config *Config) resolve(path string) string {
+	if home, err := os.UserHomeDir(); err == nil && (path == "~" || strings.HasPrefix(path, "~/")) {
+		return filepath.Join(home, path[1:])
+	}
+	if path == "" || config.path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(config.path), path)
+}
+
+// secretsDir is the configured secrets directory, or the default for where the config file is
+func (config *Config) secretsDir() string {
+	if config.SecretsDir != "" {
+		return config.resolve(config.SecretsDir)
+	}
+	if config.path != "" {
+		return config.resolve("secrets")
+	}
+	return "./secrets"
+}
+
+// keyFiles joins the configured private key files as for SAGGY_KEY_FILE, defaulting to age.key in the secrets directory
+func (config *Config) keyFiles(secretsDir string) string {
+	if len(config.KeyFiles) == 0 {
+		return filepath.Join(secretsDir, "age.key")
+	}
+	resolved := []string{}
+	for _, keyFile := range config.KeyFiles {
+		resolved = append(resolved, config.resolve(keyFile))
+	}
+	return strings.Join(resolved, string(os.PathListSeparator))
+}
+
+// publicKeysFile is the configured public keys file, defaulting to public-age-keys.json in the secrets directory
+func (config *Config) publicKeysFile(secretsDir string) string {
+	if config.PublicKeysFile != "" {
+		return config.resolve(config.PublicKeysFile)
+	}
+	return filepath.Join(secretsDir, "public-age-keys.json")
+}
+
+// keyName names this host's key by the configured scheme, defaulting to the lowercased hostname
+func (config *Config) keyName() string {
+	scheme := config.KeyName
+	if scheme == "" {
+		scheme = "{hostname}"
+	}
+	username := ""
+	if current, err := user.Current(); err == nil {
+		// Windows includes the domain, as in DOMAIN\user
+		username = current.Username[strings.LastIndex(current.Username, "\\")+1:]
+	}
+	return strings.ToLower(strings.NewReplacer("{hostname}", getHostname(), "{user}", username).Replace(scheme))
+}
+
+// tmpDir is the configured location for decrypted files; empty if a memory backed location should be found
+func (config *Config) tmpDir() string {
+	return config.resolve(config.TmpDir)
+}
+
+// recipientRules are the groups and rules to encrypt by; nil if there are no rules
+func (config *Config) recipientRules() *recipientRules {
+	if len(config.Rules) == 0 {
+		return nil
+	}
+	dir := "."
+	if config.path != "" {
+		dir = filepath.Dir(config.path)
+	}
+	if absDir, err := filepath.Abs(dir); err == nil {
+		dir = absDir
+	}
+	return &recipientRules{dir: dir, groups: config.Groups, rules: config.Rules}
+}
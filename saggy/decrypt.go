@@ -1,11 +1,9 @@
 package saggy
 
 import (
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-
-	
 )
 
 func Decrypt(keys *DecryptKey, from, to string) error {
@@ -24,62 +22,66 @@ func DecryptFile(keys *DecryptKey, from, to string) error {
 		to = unsopsifyFilename(from)
 	}
 
-	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
-		return NewSaggyError("Failed to create directory:", err)
+	reader, err := NewSafeWholeFile(from, os.O_RDONLY, 0).OpenReader()
+	if err != nil {
+		return NewSaggyError("Failed to read file:", err)
 	}
+	defer reader.Close()
 
-	cmd := exec.Command("sops", "--decrypt", from)
-	cmd.Env = []string{"SOPS_AGE_KEY_FILE=" + keys.privateKeyFilepath}
-	output, err := cmd.Output()
-
+	// The plaintext is only readable by the user
+	writer, err := NewSafeWholeFile(to, os.O_CREATE|os.O_RDWR, 0600).openWriter()
 	if err != nil {
+		return NewSaggyError("Failed to write decrypted file:", err)
+	}
+	if err := SopsDecryptStream(keys, reader, writer, sopsFormatForPath(from), from); err != nil {
+		writer.Abort()
 		return NewSaggyError("Failed to decrypt file:", err)
 	}
-
-	if err := os.WriteFile(to, output, 0644); err != nil {
+	if err := writer.Close(); err != nil {
 		return NewSaggyError("Failed to write decrypted file:", err)
 	}
 
 	return nil
 }
 
+// DecryptFolder decrypts every encrypted file in the folder into a staged copy, which is only swapped in once complete
+// On any error the destination is left as it was. Like DecryptFile, what is decrypted is only readable by the user.
 func DecryptFolder(keys *DecryptKey, from, to string) error {
 	from = filepath.Clean(from)
 	if to == "" {
 		to = unsopsifyDirectory(from)
 	}
 
-	err := filepath.WalkDir(from, func(path string, info os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			encryptedFile, err := filepath.Rel(from, path)
+	return stageFolder(to, 0700, func(stage string) error {
+		err := filepath.WalkDir(from, func(path string, info os.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
-			if !isSopsifiedFilename(encryptedFile) {
-				return nil
-			}
-			decryptedFile := filepath.Join(to, unsopsifyFilename(encryptedFile))
-			if err := os.MkdirAll(filepath.Dir(decryptedFile), 0755); err != nil {
-				return err
-			}
-			cmd := exec.Command("sops", "--decrypt", path)
-			cmd.Env = []string{"SOPS_AGE_KEY_FILE=" + keys.privateKeyFilepath}
-			output, err := cmd.Output()
-			if err != nil {
-				return err
-			}
-			if err := os.WriteFile(decryptedFile, output, 0644); err != nil {
-				return err
+			if !info.IsDir() {
+				encryptedFile, err := filepath.Rel(from, path)
+				if err != nil {
+					return err
+				}
+				if !isSopsifiedFilename(encryptedFile) {
+					return nil
+				}
+				decryptedFile := filepath.Join(stage, unsopsifyFilename(encryptedFile))
+				if err := os.MkdirAll(filepath.Dir(decryptedFile), 0700); err != nil {
+					return err
+				}
+				// The stage is only swapped in once complete, so each file can be written to directly
+				if err := streamFile(path, decryptedFile, 0600, func(r io.Reader, w io.Writer) error {
+					return SopsDecryptStream(keys, r, w, sopsFormatForPath(path), path)
+				}); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+
+		if err != nil {
+			return NewSaggyError("Failed to decrypt folder:", err)
 		}
 		return nil
 	})
-
-	if err != nil {
-		return NewSaggyError("Failed to decrypt folder:", err)
-	}
-	return nil
 }
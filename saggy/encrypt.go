@@ -1,12 +1,10 @@
 package saggy
 
 import (
-	"encoding/json"
 	"errors"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 )
 
 func Encrypt(keys *EncryptKeys, from, to string) error {
@@ -23,75 +21,79 @@ func EncryptFile(keys *EncryptKeys, from, to string) error {
 	if to == "" {
 		to = getSopsifiedFilename(from)
 	}
-
-	ageKeys := []string{}
-	for _, key := range *keys.publicKeys {
-		ageKeys = append(ageKeys, key)
-	}
-	args := []string{"--encrypt", "--age", strings.Join(ageKeys, ",")}
-	args = append(args, from, to)
-	cmd := exec.Command("sops", args...)
-	output, err := cmd.Output()
+	keys, err := keys.forPath(to)
 	if err != nil {
-		return NewExecutionError("Failed to encrypt file", string(output), cmd.ProcessState.ExitCode(), cmd.Path, cmd.Args, cmd.Dir)
+		return err
 	}
 
-	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
-		return NewSaggyError("Failed to create directory", err)
+	reader, err := NewSafeWholeFile(from, os.O_RDONLY, 0).OpenReader()
+	if err != nil {
+		return err
 	}
+	defer reader.Close()
 
-	if err := os.WriteFile(to, output, 0644); err != nil {
+	writer, err := NewSafeWholeFile(to, os.O_CREATE|os.O_RDWR, 0644).openWriter()
+	if err != nil {
+		return err
+	}
+	if err := SopsEncryptStream(keys, reader, writer, sopsFormatForPath(from), from); err != nil {
+		writer.Abort()
+		return err
+	}
+	if err := writer.Close(); err != nil {
 		return NewSaggyError("Failed to write encrypted file", err)
 	}
 	return nil
 }
 
+// EncryptFolder encrypts every file in the folder into a staged copy, which is only swapped in once complete
+// On any error the destination is left as it was; see swapFolder for how the swap itself is made safe
 func EncryptFolder(keys *EncryptKeys, from, to string) error {
 	from = filepath.Clean(from)
 	if to == "" {
 		to = getSopsifiedDirname(from)
 	}
 
-	err := filepath.WalkDir(from, func(path string, info os.DirEntry, err error) error {
-		if err != nil {
-			return NewSaggyError("Failed to walk directory", err)
-		}
-		if !info.IsDir() {
-			relPath, err := filepath.Rel(from, path)
+	return stageFolder(to, 0755, func(stage string) error {
+		err := filepath.WalkDir(from, func(path string, info os.DirEntry, err error) error {
 			if err != nil {
-				return err
+				return NewSaggyError("Failed to walk directory", err)
 			}
+			if !info.IsDir() {
+				relPath, err := filepath.Rel(from, path)
+				if err != nil {
+					return err
+				}
 
-			encryptedFile := filepath.Join(to, getSopsifiedFilename(relPath))
-			if err := os.MkdirAll(filepath.Dir(encryptedFile), 0755); err != nil {
-				return NewSaggyError("Failed to create directory", err)
-			}
+				encryptedFile := filepath.Join(stage, getSopsifiedFilename(relPath))
+				if err := os.MkdirAll(filepath.Dir(encryptedFile), 0755); err != nil {
+					return NewSaggyError("Failed to create directory", err)
+				}
 
-			ageKeys := []string{}
-			for _, key := range *keys.publicKeys {
-				ageKeys = append(ageKeys, key)
-			}
-			args := []string{"--encrypt", "--age", strings.Join(ageKeys, ",")}
-			args = append(args, path)
-			cmd := exec.Command("sops", args...)
-			output, err := cmd.Output()
-			if err != nil {
-				return NewSaggyError("Failed to encrypt file", err)
+				// Rules are matched against where the file ends up, not where it is staged
+				fileKeys, err := keys.forPath(filepath.Join(to, getSopsifiedFilename(relPath)))
+				if err != nil {
+					return err
+				}
+
+				// The stage is only swapped in once complete, so each file can be written to directly
+				if err := streamFile(path, encryptedFile, 0644, func(r io.Reader, w io.Writer) error {
+					return SopsEncryptStream(fileKeys, r, w, sopsFormatForPath(path), path)
+				}); err != nil {
+					return err
+				}
 			}
-			if err := os.WriteFile(encryptedFile, output, 0644); err != nil {
-				return NewSaggyError("Failed to write encrypted file", err)
+			return nil
+		})
+		if err != nil {
+			saggyErr := &SaggyError{}
+			if errors.As(err, &saggyErr) {
+				return saggyErr
 			}
+			return NewSaggyError("Failed to walk directory", err)
 		}
 		return nil
 	})
-	if err != nil {
-		saggyErr := &SaggyError{}
-		if errors.As(err, &saggyErr) {
-			return saggyErr
-		}
-		return NewSaggyError("Failed to walk directory", err)
-	}
-	return nil
 }
 
 func ReadAgePublicKeys(publicKeysFile string) ([]string, error) {
@@ -104,14 +106,14 @@ func ReadAgePublicKeys(publicKeysFile string) ([]string, error) {
 		return nil, NewSaggyError("Failed to read public keys file", err)
 	}
 
-	var keys map[string]string
-	if err := json.Unmarshal(data, &keys); err != nil {
-		return nil, NewSaggyError("Failed to parse public keys file", err)
+	entries, err := parsePublicKeys(data)
+	if err != nil {
+		return nil, err
 	}
 
 	publicKeys := []string{}
-	for _, value := range keys {
-		publicKeys = append(publicKeys, value)
+	for _, entry := range entries {
+		publicKeys = append(publicKeys, entry.PublicKey)
 	}
 
 	return publicKeys, nil
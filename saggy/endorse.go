@@ -0,0 +1,422 @@
+package saggy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/hkdf"
+)
+
+// signingKeyPrefix marks a signing key in the public keys file
+const signingKeyPrefix = "ed25519:"
+
+// Endorsement is a member's signature vouching for another key's entry in the public keys file
+type Endorsement struct {
+	// The name of the key that signed
+	By string `json:"by"`
+
+	// The signature over the canonical form of the endorsed entry, base64 encoded
+	Signature string `json:"signature"`
+}
+
+// Rotation is the signature a rotated key makes over the entry replacing it, so that whoever trusted it trusts the new one
+type Rotation struct {
+	// The entry as it was before the key was rotated
+	Entry *PublicKeyEntry `json:"entry"`
+
+	// The signature over the canonical form of the new entry, made with the old entry's signing key, base64 encoded
+	Signature string `json:"signature"`
+}
+
+// EndorseResult is what changed when a key was endorsed
+type EndorseResult struct {
+	KeyName    string
+	EndorsedBy string
+
+	// Whether the endorser's own signing key had to be added to its entry, which invalidates the endorsements of it
+	SigningKeyAdded bool
+}
+
+// signingKey derives the key used to sign endorsements from an age private key
+//
+// age keys can only decrypt, so a separate ed25519 key is derived from the private key. It is the same
+// on every host holding the private key, and so never needs storing.
+func (decryptKey *DecryptKey) signingKey() (ed25519.PrivateKey, error) {
+	if decryptKey.isSSH() {
+		return nil, NewSaggyErrorWithMeta("SSH keys cannot endorse other keys, as no signing key can be derived from them; endorse with an age key instead", nil, struct{ Path string }{Path: decryptKey.privateKeyFilepath})
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(decryptKey.privateKey), nil, []byte("saggy endorsement signing key v1")), seed); err != nil {
+		return nil, NewSaggyError("Failed to derive the signing key", err)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// recipient is the public key of an age or SSH private key
+func (decryptKey *DecryptKey) recipient() (string, error) {
+	if decryptKey.isSSH() {
+		return parseSSHPublicKey([]byte(decryptKey.privateKey), decryptKey.privateKeyFilepath)
+	}
+	identity, err := age.ParseX25519Identity(decryptKey.privateKey)
+	if err != nil {
+		return "", NewSaggyError("Failed to parse the private key", err)
+	}
+	return identity.Recipient().String(), nil
+}
+
+// formatSigningKey gives the public half of a signing key, as it is recorded in the public keys file
+func formatSigningKey(signingKey ed25519.PrivateKey) string {
+	return signingKeyPrefix + base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey))
+}
+
+func parseSigningKey(signingKey string) (ed25519.PublicKey, bool) {
+	if !strings.HasPrefix(signingKey, signingKeyPrefix) {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(signingKey, signingKeyPrefix))
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(data), true
+}
+
+// canonicalEntry is what an endorsement signs: the name and everything recorded about the key other than who vouches for it
+func canonicalEntry(name string, entry *PublicKeyEntry) []byte {
+	canonical := *entry
+	canonical.PublicKey = normaliseRecipient(entry.PublicKey)
+	canonical.Groups = append([]string{}, entry.Groups...)
+	sort.Strings(canonical.Groups)
+	canonical.Endorsements = nil
+	canonical.RotatedFrom = nil
+
+	data, _ := json.Marshal(struct {
+		Name string `json:"name"`
+		*PublicKeyEntry
+	}{Name: name, PublicKeyEntry: &canonical})
+	return append([]byte("saggy endorsement v1\n"), data...)
+}
+
+// isSigned checks whether any key in the public keys file has been endorsed
+func isSigned(entries map[string]*PublicKeyEntry) bool {
+	for _, entry := range entries {
+		if len(entry.Endorsements) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// endorsedBy finds a trusted member whose endorsement of the entry verifies; empty if there is none
+func endorsedBy(name string, entry *PublicKeyEntry, signers map[string]ed25519.PublicKey) string {
+	message := canonicalEntry(name, entry)
+	for _, endorsement := range entry.Endorsements {
+		signer, ok := signers[endorsement.By]
+		if !ok {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(endorsement.Signature)
+		if err == nil && ed25519.Verify(signer, message, signature) {
+			return endorsement.By
+		}
+	}
+	return ""
+}
+
+// rotatedFromTrusted checks whether the entry replaced a trusted one, whose key vouched for the entry when it was rotated
+func rotatedFromTrusted(name string, entry *PublicKeyEntry, signers map[string]ed25519.PublicKey) bool {
+	if entry.RotatedFrom == nil || entry.RotatedFrom.Entry == nil {
+		return false
+	}
+	previous := entry.RotatedFrom.Entry
+	if endorsedBy(name, previous, signers) == "" && !rotatedFromTrusted(name, previous, signers) {
+		return false
+	}
+	signingKey, ok := parseSigningKey(previous.SigningKey)
+	if !ok {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(entry.RotatedFrom.Signature)
+	return err == nil && ed25519.Verify(signingKey, canonicalEntry(name, entry), signature)
+}
+
+// verifyEndorsements works out which keys no trusted member has endorsed
+//
+// Trust starts from this host's own keys, and extends to every key endorsed by a trusted member, and so on.
+// A rotated key is trusted if the entry it replaced was, and the replaced key vouched for it.
+// A revoked key is never trusted, nor are the keys only it endorsed, however the endorsements verify.
+// Endorsements which do not verify, because the entry was changed after it was signed, are ignored.
+func (encryptKeys *EncryptKeys) verifyEndorsements() error {
+	unendorsed := make(map[string]bool)
+	for name := range encryptKeys.entries {
+		unendorsed[name] = true
+	}
+	encryptKeys.unendorsed = unendorsed
+	if encryptKeys.trustFrom == nil {
+		return nil
+	}
+
+	decryptKey, err := encryptKeys.trustFrom()
+	if err != nil {
+		return NewSaggyError("A private key is needed to check the endorsements in the public keys file", err)
+	}
+	encryptKeys.trustedFrom = decryptKey
+
+	// This host's keys are trusted, using the signing keys derived here rather than any recorded in the file
+	// SSH keys have no signing key, so are trusted without extending trust to the keys they are said to endorse
+	signers := make(map[string]ed25519.PublicKey)
+	for _, key := range decryptKey.all() {
+		recipient, err := key.recipient()
+		if err != nil {
+			return err
+		}
+		var signingKey ed25519.PrivateKey
+		if !key.isSSH() {
+			if signingKey, err = key.signingKey(); err != nil {
+				return err
+			}
+		}
+		for name, entry := range encryptKeys.entries {
+			if normaliseRecipient(entry.PublicKey) != recipient || encryptKeys.revoked[name] {
+				continue
+			}
+			delete(unendorsed, name)
+			if signingKey != nil {
+				signers[name] = signingKey.Public().(ed25519.PublicKey)
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, name := range sortedKeys(unendorsed) {
+			entry := encryptKeys.entries[name]
+			if encryptKeys.revoked[name] {
+				continue
+			}
+			if endorsedBy(name, entry, signers) == "" && !rotatedFromTrusted(name, entry, signers) {
+				continue
+			}
+			delete(unendorsed, name)
+			if signingKey, ok := parseSigningKey(entry.SigningKey); ok {
+				signers[name] = signingKey
+			}
+			changed = true
+		}
+	}
+	return nil
+}
+
+// trustFor carries which keys are unendorsed over to entries read again since, such as under a lock
+//
+// Keys which were not there when trust was worked out, or whose entries have changed since, are unendorsed.
+func (encryptKeys *EncryptKeys) trustFor(entries map[string]*PublicKeyEntry) map[string]bool {
+	if encryptKeys.unendorsed == nil {
+		return nil
+	}
+	unendorsed := make(map[string]bool)
+	for name, entry := range entries {
+		known, ok := encryptKeys.entries[name]
+		if !ok || encryptKeys.unendorsed[name] || !bytes.Equal(canonicalEntry(name, known), canonicalEntry(name, entry)) {
+			unendorsed[name] = true
+		}
+	}
+	return unendorsed
+}
+
+// checkEndorsed refuses to encrypt for any of the public keys that have been revoked, or that no trusted member has endorsed
+func (encryptKeys *EncryptKeys) checkEndorsed() error {
+	revoked := []string{}
+	for _, name := range sortedKeys(*encryptKeys.publicKeys) {
+		if encryptKeys.revoked[name] {
+			revoked = append(revoked, name)
+		}
+	}
+	if len(revoked) > 0 {
+		return NewSaggyErrorWithMeta("Refusing to encrypt for keys that have been revoked or rotated away; remove their entries from the public keys file", nil, struct{ Keys []string }{Keys: revoked})
+	}
+
+	names := []string{}
+	for _, name := range sortedKeys(*encryptKeys.publicKeys) {
+		if encryptKeys.unendorsed[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		return NewSaggyErrorWithMeta("Refusing to encrypt for keys no trusted member has endorsed; check them with saggy keys show, then endorse them with saggy keys endorse", nil, struct{ Keys []string }{Keys: names})
+	}
+	return nil
+}
+
+// trustRecordPath is where the record that a private key has been used with a signed public keys file is kept
+//
+// It is kept in the user's config directory, named for the private key file, rather than in the repository,
+// so that neither stripping every endorsement from the public keys file nor changing the repository's config
+// turns the check off.
+func trustRecordPath(privateKeyFilepath string) (string, error) {
+	abs, err := filepath.Abs(privateKeyFilepath)
+	if err != nil {
+		return "", err
+	}
+	return configRecordPath("endorsements", abs)
+}
+
+// recordTrust notes for each of the private keys that endorsements are checked, so that they always are from now on
+//
+// It is only called when endorsing or encrypting. Failing to record is warned about rather than fatal,
+// as the endorsements have still been checked this time.
+func recordTrust(decryptKey *DecryptKey) {
+	if decryptKey == nil {
+		return
+	}
+	for _, key := range decryptKey.all() {
+		path, err := trustRecordPath(key.privateKeyFilepath)
+		if err == nil {
+			err = writeConfigRecord(path, "Endorsements in the public keys file are checked for "+key.privateKeyFilepath+"; unendorsed keys are refused\n")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: failed to record that endorsements are checked for "+key.privateKeyFilepath+":", err)
+		}
+	}
+}
+
+// rememberTrust records, once the keys are used to encrypt, that endorsements are checked and which keys are revoked
+func (encryptKeys *EncryptKeys) rememberTrust() {
+	recordTrust(encryptKeys.trustedFrom)
+	recordRevocations(encryptKeys.revocations)
+}
+
+// trustRecorded checks whether any of the private keys has been used with a signed public keys file
+func trustRecorded(privateKeyFilepaths []string) bool {
+	for _, privateKeyFilepath := range privateKeyFilepaths {
+		path, err := trustRecordPath(privateKeyFilepath)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sign adds or replaces the signer's endorsement of the entry
+func (entry *PublicKeyEntry) sign(name, signerName string, signingKey ed25519.PrivateKey) {
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, canonicalEntry(name, entry)))
+	for _, endorsement := range entry.Endorsements {
+		if endorsement.By == signerName {
+			endorsement.Signature = signature
+			return
+		}
+	}
+	entry.Endorsements = append(entry.Endorsements, &Endorsement{By: signerName, Signature: signature})
+}
+
+// dropEndorsementsBy removes every endorsement made by the named key, so that it no longer vouches for anyone
+func dropEndorsementsBy(entries map[string]*PublicKeyEntry, signerName string) {
+	for _, entry := range entries {
+		kept := []*Endorsement{}
+		for _, endorsement := range entry.Endorsements {
+			if endorsement.By != signerName {
+				kept = append(kept, endorsement)
+			}
+		}
+		if len(kept) == 0 {
+			kept = nil
+		}
+		entry.Endorsements = kept
+	}
+}
+
+// Endorse signs the named key's entry with this host's key, vouching that it belongs to who it claims to
+//
+// Everything recorded about the key is signed, so the entry should be checked first. The endorser's own
+// entry gains its signing key if it does not already have one.
+func Endorse(publicKeysFilepath string, decryptKey *DecryptKey, keyName string) (*EndorseResult, error) {
+	signingKey, err := decryptKey.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := decryptKey.recipient()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EndorseResult{KeyName: keyName}
+	var revocations []*Revocation
+	err = updatePublicKeysFile(publicKeysFilepath, func(entries map[string]*PublicKeyEntry, revoked *[]*Revocation) error {
+		revocations = *revoked
+		entry, ok := entries[keyName]
+		if !ok {
+			return NewSaggyErrorWithMeta("No such key in the public keys file", nil, struct{ KeyName string }{KeyName: keyName})
+		}
+		if revokedNames(entries, *revoked)[keyName] {
+			return NewSaggyErrorWithMeta("The key has been revoked or rotated away, so cannot be endorsed", nil, struct{ KeyName string }{KeyName: keyName})
+		}
+		for name, other := range entries {
+			if normaliseRecipient(other.PublicKey) == recipient {
+				result.EndorsedBy = name
+			}
+		}
+		if result.EndorsedBy == "" {
+			return NewSaggyError("This host's key is not in the public keys file, so cannot endorse others", nil)
+		}
+		if result.EndorsedBy == keyName {
+			return NewSaggyError("A key cannot endorse itself", nil)
+		}
+		if revokedNames(entries, *revoked)[result.EndorsedBy] {
+			return NewSaggyErrorWithMeta("This host's key has been revoked or rotated away, so cannot endorse others", nil, struct{ KeyName string }{KeyName: result.EndorsedBy})
+		}
+
+		endorser := entries[result.EndorsedBy]
+		if publicSigningKey := formatSigningKey(signingKey); endorser.SigningKey != publicSigningKey {
+			endorser.SigningKey = publicSigningKey
+			result.SigningKeyAdded = true
+		}
+		entry.sign(keyName, result.EndorsedBy, signingKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordTrust(decryptKey)
+	recordRevocations(revocations)
+	return result, nil
+}
+
+// reendorse moves the endorsements made by a key over to its new signing key, for when the key is rotated
+func reendorse(entries map[string]*PublicKeyEntry, signerName string, oldSigningKey ed25519.PublicKey, newSigningKey ed25519.PrivateKey) {
+	for name, entry := range entries {
+		if name == signerName {
+			continue
+		}
+		if endorsedBy(name, entry, map[string]ed25519.PublicKey{signerName: oldSigningKey}) == signerName {
+			entry.sign(name, signerName, newSigningKey)
+		}
+	}
+}
+
+// rotateFrom records the replaced entry, signed over by its key, on the entry replacing it
+func (entry *PublicKeyEntry) rotateFrom(name string, previous *PublicKeyEntry, signingKey ed25519.PrivateKey) {
+	entry.RotatedFrom = &Rotation{
+		Entry:     previous,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, canonicalEntry(name, entry))),
+	}
+}
+
+// printEndorseResult writes who endorsed which key
+func printEndorseResult(w io.Writer, result *EndorseResult) {
+	if result == nil {
+		return
+	}
+	fmt.Fprintf(w, "endorsed %s as %s\n", result.KeyName, result.EndorsedBy)
+}
@@ -0,0 +1,145 @@
+package saggy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/getsops/sops/v3"
+)
+
+type envAssignment struct {
+	name string
+	path string
+	// The top level key to select from the secret; empty for the whole secret
+	key string
+}
+
+// parseEnvAssignment parses <varname>=<secret path>[#key]
+func parseEnvAssignment(assignment string) (*envAssignment, error) {
+	name, path, found := strings.Cut(assignment, "=")
+	if !found || path == "" {
+		return nil, NewSaggyErrorWithMeta("Expected <varname>=<secret path>", nil, struct{ Assignment string }{Assignment: assignment})
+	}
+	if !isValidEnvName(name) {
+		return nil, NewSaggyErrorWithMeta("Invalid environment variable name", nil, struct{ Name string }{Name: name})
+	}
+
+	// A # only selects a key when what follows it could be one, and the whole path is not itself a secret
+	key := ""
+	if i := strings.LastIndex(path, "#"); i >= 0 && isKeySelector(path[i+1:]) {
+		if _, err := os.Stat(path); err != nil {
+			key = path[i+1:]
+			path = path[:i]
+		}
+	}
+
+	return &envAssignment{name: name, path: path, key: key}, nil
+}
+
+// isKeySelector checks whether what follows a # could be a top level key rather than part of a path
+func isKeySelector(key string) bool {
+	return key != "" && !strings.ContainsAny(key, `/\`)
+}
+
+// decryptToBranch decrypts a file in memory and loads it as a tree of values
+func decryptToBranch(key *DecryptKey, path string) (sops.TreeBranch, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", NewSaggyError("Failed to read file", err)
+	}
+
+	format := sopsFormatForPath(path)
+	plaintext, err := SopsDecrypt(key, data, format, path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	branches, err := sopsStoreForFormat(format).LoadPlainFile(plaintext)
+	if err != nil {
+		return nil, "", NewSaggyError("Failed to parse the decrypted file", err)
+	}
+	if len(branches) == 0 {
+		return sops.TreeBranch{}, format, nil
+	}
+	return branches[0], format, nil
+}
+
+// branchValueToString renders a value from a decrypted tree as an environment variable value
+func branchValueToString(value interface{}, format string) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	case sops.TreeBranch, []interface{}:
+		data, err := sopsStoreForFormat(format).EmitValue(v)
+		if err != nil {
+			return "", NewSaggyError("Failed to render value", err)
+		}
+		return strings.TrimRight(string(data), "\n"), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// envValue decrypts the secret for an assignment in memory and returns the value to export
+func envValue(key *DecryptKey, assignment *envAssignment) (string, error) {
+	if assignment.key == "" {
+		data, err := os.ReadFile(assignment.path)
+		if err != nil {
+			return "", NewSaggyError("Failed to read file", err)
+		}
+		plaintext, err := SopsDecrypt(key, data, sopsFormatForPath(assignment.path), assignment.path)
+		if err != nil {
+			return "", err
+		}
+		return string(plaintext), nil
+	}
+
+	branch, format, err := decryptToBranch(key, assignment.path)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range branch {
+		if fmt.Sprint(item.Key) == assignment.key {
+			return branchValueToString(item.Value, format)
+		}
+	}
+	return "", NewSaggyErrorWithMeta("Key not found in secret", nil, struct {
+		Path string
+		Key  string
+	}{Path: assignment.path, Key: assignment.key})
+}
+
+// runWithEnv runs the command with the extra environment, passing its exit code through
+func runWithEnv(env []string, command []string) error {
+	if len(command) == 0 {
+		return NewSaggyError("No command provided", nil)
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	return runCommand(cmd)
+}
+
+// Env runs the command with each <varname>=<secret path>[#key] decrypted into its environment
+//
+// Secrets are only ever decrypted in memory; the plaintext never touches the disk.
+func Env(keys *Keys, assignments []string, command []string) error {
+	env := []string{}
+	for _, raw := range assignments {
+		assignment, err := parseEnvAssignment(raw)
+		if err != nil {
+			return err
+		}
+		value, err := envValue(keys.DecryptKey, assignment)
+		if err != nil {
+			return err
+		}
+		env = append(env, assignment.name+"="+value)
+	}
+
+	return runWithEnv(env, command)
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package saggy
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangeFolders swaps two folders in a single step, so there is no moment where neither is in place
+// It reports false when the filesystem or kernel cannot, so that the caller can fall back to renames
+func exchangeFolders(a, b string) (bool, error) {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+		return false, nil
+	}
+	return err == nil, err
+}
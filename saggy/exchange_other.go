@@ -0,0 +1,9 @@
+//go:build !linux
+
+package saggy
+
+// exchangeFolders swaps two folders in a single step, so there is no moment where neither is in place
+// Only linux is able to; everywhere else the caller falls back to renames
+func exchangeFolders(a, b string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,61 @@
+package saggy
+
+import (
+	"os"
+	"time"
+)
+
+// How long to wait for the command to open a FIFO when no timeout is given
+const defaultFifoTimeout = 30 * time.Second
+
+// How often to check whether the command has opened the FIFO yet
+const fifoPollInterval = 10 * time.Millisecond
+
+// deliverThroughFifo writes the data into the FIFO once the command opens it, in the background
+//
+// The returned channel receives the outcome once the data has been written, the timeout passes,
+// or exited is closed before the command opened the FIFO.
+func deliverThroughFifo(path string, data []byte, timeout time.Duration, exited <-chan struct{}) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- writeFifo(path, data, timeout, exited)
+	}()
+	return result
+}
+
+func writeFifo(path string, data []byte, timeout time.Duration, exited <-chan struct{}) error {
+	if timeout <= 0 {
+		timeout = defaultFifoTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(fifoPollInterval)
+	defer poll.Stop()
+
+	for {
+		file, err := openFifoWriter(path)
+		if err != nil {
+			return NewSaggyErrorWithMeta("Failed to open the FIFO", err, struct{ Path string }{Path: path})
+		}
+		if file != nil {
+			defer file.Close()
+			if _, err := file.Write(data); err != nil {
+				return NewSaggyErrorWithMeta("The command closed the FIFO before reading the whole secret", err, struct{ Path string }{Path: path})
+			}
+			return nil
+		}
+
+		select {
+		case <-exited:
+			return NewSaggyErrorWithMeta("The command exited without opening the FIFO", nil, struct{ Path string }{Path: path})
+		case <-deadline.C:
+			// Remove the FIFO so that a late open fails rather than waiting forever for data
+			os.Remove(path)
+			return NewSaggyErrorWithMeta("Timed out waiting for the command to open the FIFO", nil, struct {
+				Path    string
+				Timeout string
+			}{Path: path, Timeout: timeout.String()})
+		case <-poll.C:
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package saggy
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// makeFifo creates a named pipe that only the current user can open
+func makeFifo(path string) error {
+	return syscall.Mkfifo(path, 0600)
+}
+
+// openFifoWriter opens the write end of a named pipe without blocking
+// When nothing has opened the pipe for reading yet there is no file and no error
+func openFifoWriter(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return nil, nil
+	}
+	return file, err
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package saggy
+
+import (
+	"errors"
+	"os"
+)
+
+// makeFifo creates a named pipe that only the current user can open
+// Windows named pipes do not live on the filesystem, so this is not supported
+func makeFifo(path string) error {
+	return errors.New("named pipes are not supported on this platform")
+}
+
+// openFifoWriter opens the write end of a named pipe without blocking
+func openFifoWriter(path string) (*os.File, error) {
+	return nil, errors.New("named pipes are not supported on this platform")
+}
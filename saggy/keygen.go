@@ -1,7 +1,6 @@
 package saggy
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -102,6 +101,18 @@ type KeyGenParameters struct {
 	// Currently only supports json
 	// Optional; if the public keys filepath is provided it will be inferred
 	publicKeysFormat string
+
+	// Protects the private key, which is then written armored and encrypted as by age -p
+	// Optional; if not provided the private key is written in plain text
+	passphrase string
+
+	// An existing SSH public or private key to register instead of generating a new key
+	// Optional; if provided no private key is written, as the SSH private key is used directly
+	sshKeyFilepath string
+
+	// What to record about the key in the public keys file, such as its owner; the public key itself is ignored
+	// Optional; the time it was created is always recorded
+	keyInfo *PublicKeyEntry
 }
 
 type KeyGenParametersIO struct {
@@ -111,6 +122,9 @@ type KeyGenParametersIO struct {
 	publicKeysFormat string
 	readPublicKeys   func() ([]byte, error)
 	writePublicKeys  func([]byte) error
+	passphrase       string
+	importPublicKey  string
+	keyInfo          *PublicKeyEntry
 }
 
 func KeyGen_parameterised(parameters *KeyGenParameters) error {
@@ -168,7 +182,15 @@ func KeyGen_parameterised(parameters *KeyGenParameters) error {
 
 	var writePrivateKey func(data []byte) error
 
-	if parameters.privateKeyWriter != nil {
+	// An imported SSH key has its own private key file already
+	importPublicKey := ""
+	if parameters.sshKeyFilepath != "" {
+		publicKey, err := readSSHPublicKey(parameters.sshKeyFilepath)
+		if err != nil {
+			return err
+		}
+		importPublicKey = publicKey
+	} else if parameters.privateKeyWriter != nil {
 		writePrivateKey = func(data []byte) error {
 			_, err := parameters.privateKeyWriter.Write(data)
 			return err
@@ -195,6 +217,11 @@ func KeyGen_parameterised(parameters *KeyGenParameters) error {
 	if writePublicKeys == nil && readPublicKeys == nil {
 		if parameters.publicKeysFilepath != "" {
 			f := NewSafeWholeFile(parameters.publicKeysFilepath, os.O_CREATE|os.O_RDWR, 0644)
+			// Hold the lock from reading the existing keys to writing them back, so concurrent keygens don't lose keys
+			if err := f.Lock(); err != nil {
+				return err
+			}
+			defer f.Unlock()
 			writePublicKeys = f.Write
 			readPublicKeys = f.Read
 		}
@@ -207,19 +234,24 @@ func KeyGen_parameterised(parameters *KeyGenParameters) error {
 		publicKeysFormat: publicKeysFormat,
 		readPublicKeys:   readPublicKeys,
 		writePublicKeys:  writePublicKeys,
+		passphrase:       parameters.passphrase,
+		importPublicKey:  importPublicKey,
+		keyInfo:          parameters.keyInfo,
 	})
 }
 
 func KeygenToIO(opts *KeyGenParametersIO) error {
-	// Generate the keys
+	// Generate the keys, unless an existing public key is being imported
 	keys := &GenerateKeys{}
-	err := Keygen(keys)
-	if err != nil {
+	var err error
+	if opts.importPublicKey != "" {
+		keys.publicKey = opts.importPublicKey
+	} else if err = Keygen(keys); err != nil {
 		return err
 	}
 
 	// Write the private keys to the io.Writer if provided
-	if opts.writePrivateKey != nil {
+	if opts.writePrivateKey != nil && keys.privateKey != "" {
 		var data string
 		switch opts.privateKeyFormat {
 		case "age":
@@ -229,7 +261,13 @@ func KeygenToIO(opts *KeyGenParametersIO) error {
 		default:
 			return NewSaggyError("Invalid format", nil)
 		}
-		if err := opts.writePrivateKey([]byte(data)); err != nil {
+		output := []byte(data)
+		if opts.passphrase != "" {
+			if output, err = encryptWithPassphrase(output, opts.passphrase); err != nil {
+				return err
+			}
+		}
+		if err := opts.writePrivateKey(output); err != nil {
 			return err
 		}
 	}
@@ -248,29 +286,46 @@ func KeygenToIO(opts *KeyGenParametersIO) error {
 
 		case "json":
 
-			publicKeys := make(map[string]string)
+			entries := make(map[string]*PublicKeyEntry)
+			var revoked []*Revocation
 
-			// Read the existing keys
+			// Read the existing keys; a flat version 1 file is migrated by writing it back as the current version
 			if opts.readPublicKeys != nil {
 				data, err := opts.readPublicKeys()
 				if err != nil {
 					return err
 				}
 
-				if len(data) > 0 {
-
-					if err := json.Unmarshal(data, &publicKeys); err != nil {
-						return NewSaggyError("Failed to parse public keys", err)
-					}
+				if entries, revoked, err = parsePublicKeysFile(data); err != nil {
+					return err
 				}
 			}
 
 			// Add the new key
-			publicKeys[opts.keyName] = keys.publicKey
+			entry := &PublicKeyEntry{}
+			if opts.keyInfo != nil {
+				*entry = *opts.keyInfo
+			}
+			entry.PublicKey = keys.publicKey
+			if entry.Created == "" {
+				entry.Created = time.Now().UTC().Format(time.RFC3339)
+			}
+			// A generated age key can endorse others straight away; an imported SSH key cannot endorse at all
+			if keys.privateKey != "" {
+				signingKey, err := (&DecryptKey{privateKey: keys.privateKey}).signingKey()
+				if err != nil {
+					return err
+				}
+				entry.SigningKey = formatSigningKey(signingKey)
+			}
+			if err := entry.validate(); err != nil {
+				return err
+			}
+			entries[opts.keyName] = entry
 
 			// Write the keys
-			if data, err := json.Marshal(publicKeys); err != nil {
-				return NewSaggyError("Failed to marshal public keys", err)
+			if data, err := marshalPublicKeys(entries, revoked); err != nil {
+				return err
 			} else if err := opts.writePublicKeys(data); err != nil {
 				return err
 			}
@@ -1,19 +1,62 @@
 package saggy
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
+	"time"
+
+	"filippo.io/age"
 )
 
 type EncryptKeys struct {
 	publicKeys         *map[string]string
 	publicKeysFilepath string
+
+	// Everything recorded about each key in the public keys file, by key name
+	// Optional; only needed to write the public keys file back
+	entries map[string]*PublicKeyEntry
+
+	// Which of the public keys each path is encrypted for
+	// Optional; if not provided every file is encrypted for every key
+	rules *recipientRules
+
+	// Loads the private keys that trust in a signed public keys file starts from
+	// Optional; without it no key in a signed public keys file is trusted
+	trustFrom func() (*DecryptKey, error)
+
+	// The private keys that trust was worked out from, which are recorded as checking endorsements once used to encrypt
+	// Optional; nil unless the public keys file is signed
+	trustedFrom *DecryptKey
+
+	// The keys revoked or rotated away in the public keys file, which are recorded here once used to encrypt
+	// Optional
+	revocations []*Revocation
+
+	// The keys which have been revoked, by key name; nothing is encrypted for them, however they are endorsed
+	// Optional; empty unless a key in the public keys file has been revoked
+	revoked map[string]bool
+
+	// The keys which no trusted member has endorsed, by key name; nothing is encrypted for them
+	// Optional; empty unless the public keys file is signed
+	unendorsed map[string]bool
+
+	// When each key that has expired did so, by key name; encrypting for them is warned about
+	// Optional; empty if no key has an expiry date that has passed
+	expired map[string]string
 }
 
 type DecryptKey struct {
 	privateKeyFilepath string
 	privateKey         string
+
+	// The passphrase protecting the private key file; empty if it is not protected
+	passphrase string
+
+	// Further private keys to try when this one is not a recipient, from the same file or other key files
+	// Optional
+	others []*DecryptKey
 }
 
 type GenerateKeys struct {
@@ -38,31 +81,36 @@ type Keys struct {
 }
 
 func (encryptKeys *EncryptKeys) Read(filepath string) error {
-	keys := make(map[string]string)
-
 	// Open the file
-	var filedata_string string
 	filedata_bytes, err := os.ReadFile(filepath)
 	if err != nil && os.IsNotExist(err) {
 		// No such file, therefore no data to read
-		filedata_string = ""
+		filedata_bytes = nil
 	} else if err != nil {
 		// The file might exist, but for some other reason we can't open it
 		return NewSaggyError("Failed to open public keys file", err)
-	} else {
-		filedata_string = string(filedata_bytes)
 	}
 
-	// If the file is empty, there are no keys to read
-	if len(filedata_string) > 0 {
-		// Read the keys from the file
-		if err := json.NewDecoder(strings.NewReader(filedata_string)).Decode(&keys); err != nil {
-			return NewSaggyError("Failed to parse public keys file", err)
-		}
+	// Read the keys from the file, in either the flat or the versioned layout
+	entries, revocations, err := parsePublicKeysFile(filedata_bytes)
+	if err != nil {
+		return err
 	}
+	keys := publicKeysByName(entries)
 
 	encryptKeys.publicKeys = &keys
 	encryptKeys.publicKeysFilepath = filepath
+	encryptKeys.entries = entries
+	encryptKeys.revocations = revocations
+	encryptKeys.revoked = revokedNames(entries, revocations)
+	encryptKeys.expired = expiredKeys(entries, time.Now())
+
+	// Once any key has been endorsed, only keys endorsed by a trusted member can be encrypted for
+	if requireEndorsements || isSigned(entries) {
+		if err := encryptKeys.verifyEndorsements(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -78,25 +126,93 @@ func (decryptKey *DecryptKey) Read(filepath string) error {
 		return NewSaggyError("Failed to open private key file", err)
 	}
 
-	// Read the key
+	// Unlock the key if it is protected by a passphrase
+	passphrase := ""
+	if isPassphraseProtected(filedata_bytes) {
+		passphrase, err = readPassphrase("Enter passphrase for "+filepath+": ", false)
+		if err != nil {
+			return err
+		}
+		filedata_bytes, err = decryptWithPassphrase(filedata_bytes, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	return decryptKey.parse(filepath, filedata_bytes, passphrase)
+}
+
+// parse reads the keys from the unlocked contents of a private key file
+func (decryptKey *DecryptKey) parse(filepath string, filedata_bytes []byte, passphrase string) error {
+	// SSH keys are kept whole, and parsed when they are used
+	if isSSHPrivateKey(filedata_bytes) {
+		decryptKey.privateKeyFilepath = filepath
+		decryptKey.privateKey = string(filedata_bytes)
+		decryptKey.passphrase = passphrase
+		return nil
+	}
+
+	// Read every key in the file; the first is this key, and the rest are tried after it
 	filedata_string := string(filedata_bytes)
-	privateKey := ""
+	privateKeys := []string{}
 	for _, line := range strings.Split(filedata_string, "\n") {
 		if strings.HasPrefix(line, "AGE-SECRET-KEY-") {
-			privateKey = line
-			break
+			privateKeys = append(privateKeys, strings.TrimSpace(line))
 		}
 	}
-	if privateKey == "" {
+	if len(privateKeys) == 0 {
 		return NewSaggyError("Failed to find the private key in the file", nil)
 	}
 
 	decryptKey.privateKeyFilepath = filepath
-	decryptKey.privateKey = privateKey
+	decryptKey.privateKey = privateKeys[0]
+	decryptKey.passphrase = passphrase
+	for _, privateKey := range privateKeys[1:] {
+		decryptKey.others = append(decryptKey.others, &DecryptKey{
+			privateKeyFilepath: filepath,
+			privateKey:         privateKey,
+			passphrase:         passphrase,
+		})
+	}
 
 	return nil
 }
 
+// all lists this key followed by every other key to try
+func (decryptKey *DecryptKey) all() []*DecryptKey {
+	return append([]*DecryptKey{decryptKey}, decryptKey.others...)
+}
+
+// keyFile is the one unprotected age key file every key was read from, which the sops binary can be given
+//
+// It is empty if the keys came from several files, or any key is an SSH key or was unlocked with a passphrase,
+// in which case decryption is done in-process rather than handing the unlocked keys to another process.
+func (decryptKey *DecryptKey) keyFile() string {
+	for _, key := range decryptKey.all() {
+		if key.isSSH() || key.passphrase != "" || key.privateKeyFilepath != decryptKey.privateKeyFilepath {
+			return ""
+		}
+	}
+	return decryptKey.privateKeyFilepath
+}
+
+// isSSH checks whether the private key is an SSH key rather than an age key
+func (decryptKey *DecryptKey) isSSH() bool {
+	return isSSHPrivateKey([]byte(decryptKey.privateKey))
+}
+
+// identity parses the private key, whether it is an age or SSH key
+func (decryptKey *DecryptKey) identity() (age.Identity, error) {
+	if decryptKey.isSSH() {
+		return parseSSHIdentity([]byte(decryptKey.privateKey), decryptKey.privateKeyFilepath)
+	}
+	identity, err := age.ParseX25519Identity(decryptKey.privateKey)
+	if err != nil {
+		return nil, NewSaggyError("Failed to parse the private key", err)
+	}
+	return identity, nil
+}
+
 func DecryptKeysFromFile(privateKeyFilepath string) (*DecryptKey, error) {
 	decryptKey := &DecryptKey{}
 	if err := decryptKey.Read(privateKeyFilepath); err != nil {
@@ -105,6 +221,44 @@ func DecryptKeysFromFile(privateKeyFilepath string) (*DecryptKey, error) {
 	return decryptKey, nil
 }
 
+// DecryptKeysFromFiles reads every key from every file; the first key of the first file is the one used for rotation
+//
+// Files which do not exist are skipped with a warning, so that a key file listed everywhere but only present
+// on some hosts does not stop the rest being used; the first that does exist is then the one used for rotation.
+// It only fails for a missing file if none of the files exist.
+func DecryptKeysFromFiles(privateKeyFilepaths []string) (*DecryptKey, error) {
+	if len(privateKeyFilepaths) == 0 {
+		return nil, NewSaggyError("No private key files provided", nil)
+	}
+	var decryptKey *DecryptKey
+	var missing []string
+	var missingErr error
+	for _, privateKeyFilepath := range privateKeyFilepaths {
+		key, err := DecryptKeysFromFile(privateKeyFilepath)
+		if errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, privateKeyFilepath)
+			if missingErr == nil {
+				missingErr = err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if decryptKey == nil {
+			decryptKey = key
+		} else {
+			decryptKey.others = append(decryptKey.others, key.all()...)
+		}
+	}
+	if decryptKey == nil {
+		return nil, missingErr
+	}
+	for _, privateKeyFilepath := range missing {
+		fmt.Fprintln(os.Stderr, "Skipping the private key file "+privateKeyFilepath+", which does not exist")
+	}
+	return decryptKey, nil
+}
+
 func EncryptKeysFromFile(publicKeysFilepath string) (*EncryptKeys, error) {
 	encryptKeys := &EncryptKeys{}
 	if err := encryptKeys.Read(publicKeysFilepath); err != nil {
@@ -113,12 +267,25 @@ func EncryptKeysFromFile(publicKeysFilepath string) (*EncryptKeys, error) {
 	return encryptKeys, nil
 }
 
-func KeysFromFiles(publicKeysFilepath, privateKeyFilepath string) (*Keys, error) {
-	encryptKeys, err := EncryptKeysFromFile(publicKeysFilepath)
+// EncryptKeysFromFileTrusting reads the public keys, trusting those endorsed from the private keys that trustFrom loads
+//
+// trustFrom is only called if the public keys file is signed, so an unsigned file never needs the private keys.
+func EncryptKeysFromFileTrusting(publicKeysFilepath string, trustFrom func() (*DecryptKey, error)) (*EncryptKeys, error) {
+	encryptKeys := &EncryptKeys{trustFrom: trustFrom}
+	if err := encryptKeys.Read(publicKeysFilepath); err != nil {
+		return nil, err
+	}
+	return encryptKeys, nil
+}
+
+func KeysFromFiles(publicKeysFilepath string, privateKeyFilepaths ...string) (*Keys, error) {
+	decryptKey, err := DecryptKeysFromFiles(privateKeyFilepaths)
 	if err != nil {
 		return nil, err
 	}
-	decryptKey, err := DecryptKeysFromFile(privateKeyFilepath)
+	encryptKeys, err := EncryptKeysFromFileTrusting(publicKeysFilepath, func() (*DecryptKey, error) {
+		return decryptKey, nil
+	})
 	if err != nil {
 		return nil, err
 	}
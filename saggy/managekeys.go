@@ -0,0 +1,255 @@
+package saggy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// checkDuplicatePublicKeys rejects the same public key registered under more than one name
+func checkDuplicatePublicKeys(entries map[string]*PublicKeyEntry) error {
+	names := make(map[string]string)
+	for _, name := range sortedKeys(entries) {
+		publicKey := normaliseRecipient(entries[name].PublicKey)
+		if other, ok := names[publicKey]; ok {
+			return NewSaggyErrorWithMeta("The same public key is registered under more than one name", nil, struct {
+				Names     []string
+				PublicKey string
+			}{Names: []string{other, name}, PublicKey: publicKey})
+		}
+		names[publicKey] = name
+	}
+	return nil
+}
+
+// ListKeys reads every key in the public keys file, refusing to work on duplicated keys
+func ListKeys(publicKeysFilepath string) (map[string]*PublicKeyEntry, error) {
+	encryptKeys, err := EncryptKeysFromFile(publicKeysFilepath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDuplicatePublicKeys(encryptKeys.entries); err != nil {
+		return nil, err
+	}
+	return encryptKeys.entries, nil
+}
+
+// updatePublicKeys applies a change to the public keys file, holding its lock from reading it to writing it back
+func updatePublicKeys(publicKeysFilepath string, update func(entries map[string]*PublicKeyEntry) error) error {
+	return updatePublicKeysFile(publicKeysFilepath, func(entries map[string]*PublicKeyEntry, _ *[]*Revocation) error {
+		return update(entries)
+	})
+}
+
+// updatePublicKeysFile applies a change to the public keys file, which may also revoke keys
+func updatePublicKeysFile(publicKeysFilepath string, update func(entries map[string]*PublicKeyEntry, revoked *[]*Revocation) error) error {
+	publicKeysFile := NewSafeWholeFile(publicKeysFilepath, os.O_CREATE|os.O_RDWR, 0644)
+	if err := publicKeysFile.Lock(); err != nil {
+		return err
+	}
+	defer publicKeysFile.Unlock()
+
+	data, err := publicKeysFile.Read()
+	if err != nil {
+		return err
+	}
+	entries, revoked, err := parsePublicKeysFile(data)
+	if err != nil {
+		return err
+	}
+	if err := checkDuplicatePublicKeys(entries); err != nil {
+		return err
+	}
+
+	if err := update(entries, &revoked); err != nil {
+		return err
+	}
+
+	if data, err = marshalPublicKeys(entries, revoked); err != nil {
+		return err
+	}
+	return publicKeysFile.Write(data)
+}
+
+// AddKey registers someone else's public key, so that secrets are encrypted for them too
+//
+// The key must parse as an age or SSH public key, and neither the name nor the key may already be registered,
+// nor may the key have been revoked.
+func AddKey(publicKeysFilepath, keyName, publicKey string, keyInfo *PublicKeyEntry) error {
+	if keyName == "" {
+		return NewSaggyError("Key name is not set", nil)
+	}
+	publicKey = strings.TrimSpace(publicKey)
+	if _, err := parseRecipient(publicKey); err != nil {
+		return NewSaggyErrorWithMeta("Not a valid age or SSH public key", err, struct{ PublicKey string }{PublicKey: publicKey})
+	}
+	publicKey = normaliseRecipient(publicKey)
+
+	return updatePublicKeysFile(publicKeysFilepath, func(entries map[string]*PublicKeyEntry, revoked *[]*Revocation) error {
+		if _, ok := entries[keyName]; ok {
+			return NewSaggyErrorWithMeta("A key is already registered with that name", nil, struct{ KeyName string }{KeyName: keyName})
+		}
+		if isRevoked(*revoked, publicKey) {
+			return NewSaggyErrorWithMeta("The public key has been revoked or rotated away, so cannot be added again", nil, struct{ KeyName string }{KeyName: keyName})
+		}
+		for name, entry := range entries {
+			if normaliseRecipient(entry.PublicKey) == publicKey {
+				return NewSaggyErrorWithMeta("The public key is already registered under another name", nil, struct {
+					KeyName      string
+					ExistingName string
+				}{KeyName: keyName, ExistingName: name})
+			}
+		}
+
+		entry := &PublicKeyEntry{}
+		if keyInfo != nil {
+			*entry = *keyInfo
+		}
+		entry.PublicKey = publicKey
+		if entry.Created == "" {
+			entry.Created = time.Now().UTC().Format(time.RFC3339)
+		}
+		if err := entry.validate(); err != nil {
+			return err
+		}
+		entries[keyName] = entry
+		return nil
+	})
+}
+
+// checkRemovable refuses to remove a key which is not registered, is the only one left, or is named by a rule
+//
+// Rules naming a missing key fail for every path they match, whereas missing members of a group are skipped.
+func checkRemovable(entries map[string]*PublicKeyEntry, keyName string, rules *recipientRules) error {
+	if _, ok := entries[keyName]; !ok {
+		return NewSaggyErrorWithMeta("No such key in the public keys file", nil, struct{ KeyName string }{KeyName: keyName})
+	}
+	if len(entries) == 1 {
+		return NewSaggyErrorWithMeta("Refusing to remove the only key; there would be no recipients left", nil, struct{ KeyName string }{KeyName: keyName})
+	}
+	if paths := rules.naming(keyName); len(paths) > 0 {
+		return NewSaggyErrorWithMeta("Refusing to remove a key that rules name directly; take it out of them first", nil, struct {
+			KeyName string
+			Rules   []string
+		}{KeyName: keyName, Rules: paths})
+	}
+	return nil
+}
+
+// RemoveKey unregisters a public key, returning what was recorded about it
+//
+// Nothing is re-encrypted, so existing secrets stay readable with the key; revoke does both.
+func RemoveKey(publicKeysFilepath, keyName string, rules *recipientRules) (*PublicKeyEntry, error) {
+	var removed *PublicKeyEntry
+	err := updatePublicKeys(publicKeysFilepath, func(entries map[string]*PublicKeyEntry) error {
+		if err := checkRemovable(entries, keyName, rules); err != nil {
+			return err
+		}
+		removed = entries[keyName]
+		delete(entries, keyName)
+		dropEndorsementsBy(entries, keyName)
+		return nil
+	})
+	return removed, err
+}
+
+// isExpired checks whether the entry's expiry date has passed; entries without one never expire
+func (entry *PublicKeyEntry) isExpired(now time.Time) bool {
+	if entry.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, entry.Expires)
+	return err == nil && now.After(expires)
+}
+
+// expiredKeys finds when each key whose expiry date has passed expired, by key name
+func expiredKeys(entries map[string]*PublicKeyEntry, now time.Time) map[string]string {
+	expired := make(map[string]string)
+	for name, entry := range entries {
+		if entry.isExpired(now) {
+			expired[name] = entry.Expires
+		}
+	}
+	return expired
+}
+
+// warnedExpired is the keys already warned about, so that encrypting a folder warns once for each key
+var warnedExpired = make(map[string]bool)
+
+// warnExpired warns about encrypting for any of the public keys that have expired
+//
+// An expired key is still encrypted for, as refusing would leave its holder unable to read new secrets
+// with no warning; it is up to the members to rotate or revoke it.
+func (encryptKeys *EncryptKeys) warnExpired() {
+	for _, name := range sortedKeys(*encryptKeys.publicKeys) {
+		expires, ok := encryptKeys.expired[name]
+		if !ok || warnedExpired[name] {
+			continue
+		}
+		warnedExpired[name] = true
+		fmt.Fprintln(os.Stderr, "Warning: encrypting for "+name+", which expired on "+expires+"; rotate or revoke it")
+	}
+}
+
+// printKeysList writes one line per key, with its name, type, owner and public key
+func printKeysList(w io.Writer, entries map[string]*PublicKeyEntry) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	now := time.Now()
+	for _, name := range sortedKeys(entries) {
+		entry := entries[name]
+		status := ""
+		if entry.isExpired(now) {
+			status = " (expired)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s%s\n", name, orDash(entry.Type), orDash(entry.Owner), entry.PublicKey, status)
+	}
+	table.Flush()
+}
+
+// printKeyDetails writes everything recorded about each of the named keys
+func printKeyDetails(w io.Writer, entries map[string]*PublicKeyEntry, names []string) {
+	now := time.Now()
+	for i, name := range names {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		entry := entries[name]
+		fmt.Fprintln(w, name)
+		fmt.Fprintf(w, "\tpublic key: %s\n", entry.PublicKey)
+		for _, field := range [][2]string{
+			{"owner", entry.Owner},
+			{"type", entry.Type},
+			{"groups", strings.Join(entry.Groups, ", ")},
+			{"comment", entry.Comment},
+			{"created", entry.Created},
+			{"expires", entry.Expires},
+		} {
+			if field[1] != "" {
+				fmt.Fprintf(w, "\t%s: %s\n", field[0], field[1])
+			}
+		}
+		if len(entry.Endorsements) > 0 {
+			endorsers := []string{}
+			for _, endorsement := range entry.Endorsements {
+				endorsers = append(endorsers, endorsement.By)
+			}
+			fmt.Fprintf(w, "\tendorsed by: %s\n", strings.Join(endorsers, ", "))
+		}
+		if entry.RotatedFrom != nil && entry.RotatedFrom.Entry != nil {
+			fmt.Fprintf(w, "\trotated from: %s\n", entry.RotatedFrom.Entry.PublicKey)
+		}
+		if entry.isExpired(now) {
+			fmt.Fprintln(w, "\texpired")
+		}
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
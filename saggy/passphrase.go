@@ -0,0 +1,131 @@
+package saggy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/term"
+)
+
+// isPassphraseProtected checks whether a private key file has been encrypted with a passphrase, as by age -p
+func isPassphraseProtected(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return bytes.HasPrefix(trimmed, []byte(armor.Header)) || bytes.HasPrefix(trimmed, []byte("age-encryption.org/"))
+}
+
+// encryptWithPassphrase encrypts the private key file contents with the passphrase, armored so it stays text
+func encryptWithPassphrase(data []byte, passphrase string) ([]byte, error) {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, NewSaggyError("Failed to use the passphrase", err)
+	}
+
+	output := &bytes.Buffer{}
+	armored := armor.NewWriter(output)
+	encrypted, err := age.Encrypt(armored, recipient)
+	if err != nil {
+		return nil, NewSaggyError("Failed to encrypt the private key", err)
+	}
+	if _, err := encrypted.Write(data); err != nil {
+		return nil, NewSaggyError("Failed to encrypt the private key", err)
+	}
+	if err := encrypted.Close(); err != nil {
+		return nil, NewSaggyError("Failed to encrypt the private key", err)
+	}
+	if err := armored.Close(); err != nil {
+		return nil, NewSaggyError("Failed to encrypt the private key", err)
+	}
+	return output.Bytes(), nil
+}
+
+// decryptWithPassphrase decrypts private key file contents protected by encryptWithPassphrase or age -p
+func decryptWithPassphrase(data []byte, passphrase string) ([]byte, error) {
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, NewSaggyError("Failed to use the passphrase", err)
+	}
+
+	var reader io.Reader = bytes.NewReader(bytes.TrimSpace(data))
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		reader = armor.NewReader(reader)
+	}
+
+	decrypted, err := age.Decrypt(reader, identity)
+	noMatch := &age.NoIdentityMatchError{}
+	if errors.As(err, &noMatch) {
+		return nil, NewSaggyError("Incorrect passphrase for the private key", nil)
+	} else if err != nil {
+		return nil, NewSaggyError("Failed to decrypt the private key; it is not protected by a passphrase alone", err)
+	}
+
+	output, err := io.ReadAll(decrypted)
+	if err != nil {
+		return nil, NewSaggyError("Failed to decrypt the private key", err)
+	}
+	return output, nil
+}
+
+// readPassphrase gets a passphrase from SAGGY_PASSPHRASE, SAGGY_PASSPHRASE_FILE, or else by asking at the terminal
+// When confirm is set the terminal asks twice, for passphrases that are being chosen rather than entered
+func readPassphrase(prompt string, confirm bool) (string, error) {
+	if passphrase := getEnv("SAGGY_PASSPHRASE", ""); passphrase != "" {
+		return passphrase, nil
+	}
+
+	if passphraseFile := getEnv("SAGGY_PASSPHRASE_FILE", ""); passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return "", NewSaggyErrorWithMeta("Failed to read the passphrase file", err, struct{ Path string }{Path: passphraseFile})
+		}
+		passphrase := strings.TrimRight(string(data), "\r\n")
+		if passphrase == "" {
+			return "", NewSaggyErrorWithMeta("The passphrase file is empty", nil, struct{ Path string }{Path: passphraseFile})
+		}
+		return passphrase, nil
+	}
+
+	passphrase, err := promptPassphrase(prompt)
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		again, err := promptPassphrase("Confirm passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", NewSaggyError("The passphrases do not match", nil)
+		}
+	}
+	return passphrase, nil
+}
+
+// promptPassphrase asks for a passphrase at the terminal without echoing it
+func promptPassphrase(prompt string) (string, error) {
+	tty, err := os.OpenFile(ttyPath, os.O_RDWR, 0)
+	if err != nil {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", NewSaggyError("A passphrase is needed but there is no terminal to ask for it; set SAGGY_PASSPHRASE or SAGGY_PASSPHRASE_FILE", nil)
+		}
+		tty = os.Stdin
+	} else {
+		defer tty.Close()
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", NewSaggyError("Failed to read the passphrase", err)
+	}
+	if len(passphrase) == 0 {
+		return "", NewSaggyError("The passphrase is empty", nil)
+	}
+	return string(passphrase), nil
+}
@@ -0,0 +1,6 @@
+//go:build windows
+
+package saggy
+
+// The console, for asking for a passphrase even when stdin is in use
+const ttyPath = "CONIN$"
@@ -0,0 +1,117 @@
+package saggy
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// The formats sops can read and write
+var sopsFormats = []string{"binary", "dotenv", "ini", "json", "yaml"}
+
+func isSopsFormat(format string) bool {
+	for _, known := range sopsFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// EncryptIO encrypts everything from the reader to the writer; the counterpart of EncryptFile for streams
+// As there is no filename to infer it from, the format must be given
+func EncryptIO(keys *EncryptKeys, r io.Reader, w io.Writer, format string) error {
+	if !isSopsFormat(format) {
+		return NewSaggyErrorWithMeta("Unknown format", nil, struct{ Format string }{Format: format})
+	}
+	return SopsEncryptStream(keys, r, w, format, "")
+}
+
+// DecryptIO decrypts everything from the reader to the writer; the counterpart of DecryptFile for streams
+// As there is no filename to infer it from, the format must be given
+func DecryptIO(key *DecryptKey, r io.Reader, w io.Writer, format string) error {
+	if !isSopsFormat(format) {
+		return NewSaggyErrorWithMeta("Unknown format", nil, struct{ Format string }{Format: format})
+	}
+	return SopsDecryptStream(key, r, w, format, "")
+}
+
+// pipeFormat works out the format when piping, where "-" is stdin or stdout
+//
+// An explicit input or output type wins, then whichever end is a file, and failing that binary.
+// Sops can only be asked to use one format here, so the input and output types must agree.
+func pipeFormat(source, destination, inputType, outputType string) (string, error) {
+	if inputType != "" && outputType != "" && inputType != outputType {
+		return "", NewSaggyError("Converting between formats is not supported; the input and output types must match", nil)
+	}
+	for _, format := range []string{inputType, outputType} {
+		if format == "" {
+			continue
+		}
+		if !isSopsFormat(format) {
+			return "", NewSaggyErrorWithMeta("Unknown format", nil, struct{ Format string }{Format: format})
+		}
+		return format, nil
+	}
+
+	for _, path := range []string{source, destination} {
+		if path != "-" && path != "" {
+			return sopsFormatForPath(path), nil
+		}
+	}
+	return "binary", nil
+}
+
+// pipe streams the source through the transform into the destination, where "-" is stdin or stdout
+// A destination file is only replaced once the transform has succeeded, and is created with perms
+func pipe(source, destination string, perms fs.FileMode, transform func(r io.Reader, w io.Writer) error) error {
+	var reader io.Reader = os.Stdin
+	if source != "-" {
+		if is_dir, err := isDir(source); err != nil {
+			return err
+		} else if is_dir {
+			return NewSaggyErrorWithMeta("Folders cannot be piped", nil, struct{ Path string }{Path: source})
+		}
+		file, err := NewSafeWholeFile(source, os.O_RDONLY, 0).OpenReader()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	if destination == "-" {
+		return transform(reader, os.Stdout)
+	}
+
+	writer, err := NewSafeWholeFile(destination, os.O_CREATE|os.O_RDWR, perms).openWriter()
+	if err != nil {
+		return err
+	}
+	if err := transform(reader, writer); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+// EncryptPipe encrypts between files, stdin and stdout, where "-" is stdin or stdout
+func EncryptPipe(keys *EncryptKeys, source, destination, format string) error {
+	// Only a destination file has a path for the rules to match
+	if destination != "-" {
+		var err error
+		if keys, err = keys.forPath(destination); err != nil {
+			return err
+		}
+	}
+	return pipe(source, destination, 0644, func(r io.Reader, w io.Writer) error {
+		return EncryptIO(keys, r, w, format)
+	})
+}
+
+// DecryptPipe decrypts between files, stdin and stdout, where "-" is stdin or stdout
+func DecryptPipe(key *DecryptKey, source, destination, format string) error {
+	return pipe(source, destination, 0600, func(r io.Reader, w io.Writer) error {
+		return DecryptIO(key, r, w, format)
+	})
+}
@@ -0,0 +1,212 @@
+package saggy
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// publicKeysVersion is the layout written to the public keys file
+//
+// Version 1 is the original flat map of key names to public keys, and has no version field.
+// Version 2 keeps each public key alongside what is known about it.
+const publicKeysVersion = 2
+
+// PublicKeyEntry is a key in the public keys file, along with what is known about it
+type PublicKeyEntry struct {
+	// The age or SSH public key
+	PublicKey string `json:"publicKey"`
+
+	// Who holds the private key
+	// Optional
+	Owner string `json:"owner,omitempty"`
+
+	// When the key was added, in RFC 3339 format
+	// Optional; unknown for keys migrated from version 1
+	Created string `json:"created,omitempty"`
+
+	// Optional
+	Comment string `json:"comment,omitempty"`
+
+	// When the key should no longer be used, in RFC 3339 format
+	// Optional; keys do not expire by default
+	Expires string `json:"expires,omitempty"`
+
+	// The groups the key belongs to, in addition to any listed in the config file
+	// Optional
+	Groups []string `json:"groups,omitempty"`
+
+	// What kind of key this is, e.g. user, machine or ci
+	// Optional
+	Type string `json:"type,omitempty"`
+
+	// The key this member signs endorsements with, derived from their age private key
+	// Optional; set by keygen, or the first time the member endorses a key
+	SigningKey string `json:"signingKey,omitempty"`
+
+	// Signatures from other members vouching for this entry
+	// Optional; once any key is endorsed, only endorsed keys are encrypted for
+	Endorsements []*Endorsement `json:"endorsements,omitempty"`
+
+	// The entry this key replaced, and the replaced key's signature vouching for this one
+	// Optional; set by rotate once endorsements are checked, if the replaced entry has a signing key
+	RotatedFrom *Rotation `json:"rotatedFrom,omitempty"`
+}
+
+// publicKeysFileV2 is the layout of version 2 of the public keys file
+type publicKeysFileV2 struct {
+	Version int                        `json:"version"`
+	Keys    map[string]*PublicKeyEntry `json:"keys"`
+
+	// The keys that have been revoked or rotated away, which are never encrypted for again
+	// Optional
+	Revoked []*Revocation `json:"revoked,omitempty"`
+}
+
+// parsePublicKeys reads either version of the public keys file into entries by key name
+func parsePublicKeys(data []byte) (map[string]*PublicKeyEntry, error) {
+	entries, _, err := parsePublicKeysFile(data)
+	return entries, err
+}
+
+// parsePublicKeysFile reads either version of the public keys file into entries by key name, and the keys revoked
+func parsePublicKeysFile(data []byte) (map[string]*PublicKeyEntry, []*Revocation, error) {
+	entries := make(map[string]*PublicKeyEntry)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return entries, nil, nil
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, NewSaggyError("Failed to parse public keys file", err)
+	}
+
+	// A version 1 file could have a key named version, but its value would be a string rather than a number
+	var version int
+	if raw, ok := fields["version"]; !ok || json.Unmarshal(raw, &version) != nil {
+		if err := checkDuplicateNames(data); err != nil {
+			return nil, nil, err
+		}
+		flat := make(map[string]string)
+		if err := json.Unmarshal(data, &flat); err != nil {
+			return nil, nil, NewSaggyError("Failed to parse public keys file", err)
+		}
+		for name, publicKey := range flat {
+			entries[name] = &PublicKeyEntry{PublicKey: publicKey}
+		}
+		return entries, nil, nil
+	}
+
+	if version != publicKeysVersion {
+		return nil, nil, NewSaggyErrorWithMeta("Unsupported public keys file version; a newer saggy may be needed", nil, struct{ Version int }{Version: version})
+	}
+	if err := checkDuplicateNames(fields["keys"]); err != nil {
+		return nil, nil, err
+	}
+	file := &publicKeysFileV2{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, nil, NewSaggyError("Failed to parse public keys file", err)
+	}
+	for name, entry := range file.Keys {
+		if entry == nil || entry.PublicKey == "" {
+			return nil, nil, NewSaggyErrorWithMeta("Public keys file entry has no public key", nil, struct{ Name string }{Name: name})
+		}
+		entries[name] = entry
+	}
+	for _, revocation := range file.Revoked {
+		if revocation == nil || revocation.PublicKey == "" {
+			return nil, nil, NewSaggyError("Public keys file revocation has no public key", nil)
+		}
+	}
+	return entries, file.Revoked, nil
+}
+
+// checkDuplicateNames rejects a json object naming the same key twice, which would otherwise silently keep only the last
+func checkDuplicateNames(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil {
+		return NewSaggyError("Failed to parse public keys file", err)
+	} else if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return NewSaggyError("Failed to parse public keys file", err)
+		}
+		name, _ := token.(string)
+		if seen[name] {
+			return NewSaggyErrorWithMeta("The public keys file lists the same name more than once", nil, struct{ Name string }{Name: name})
+		}
+		seen[name] = true
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return NewSaggyError("Failed to parse public keys file", err)
+		}
+	}
+	return nil
+}
+
+// marshalPublicKeys writes the entries and the keys revoked as the current version of the public keys file
+func marshalPublicKeys(entries map[string]*PublicKeyEntry, revoked []*Revocation) ([]byte, error) {
+	data, err := json.MarshalIndent(&publicKeysFileV2{Version: publicKeysVersion, Keys: entries, Revoked: revoked}, "", "  ")
+	if err != nil {
+		return nil, NewSaggyError("Failed to marshal public keys", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// publicKeysByName flattens the entries into the public key of each name
+func publicKeysByName(entries map[string]*PublicKeyEntry) map[string]string {
+	publicKeys := make(map[string]string)
+	for name, entry := range entries {
+		publicKeys[name] = entry.PublicKey
+	}
+	return publicKeys
+}
+
+// entriesInGroup lists the keys whose entries put them in the group
+func entriesInGroup(entries map[string]*PublicKeyEntry, group string) []string {
+	members := []string{}
+	for name, entry := range entries {
+		for _, g := range entry.Groups {
+			if g == group {
+				members = append(members, name)
+				break
+			}
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// normaliseKeyDate accepts either a date, as in 2006-01-02, or an RFC 3339 time, and gives it in RFC 3339 format
+func normaliseKeyDate(date string) (string, error) {
+	if t, err := time.Parse(time.DateOnly, date); err == nil {
+		return t.Format(time.RFC3339), nil
+	}
+	if _, err := time.Parse(time.RFC3339, date); err != nil {
+		return "", err
+	}
+	return date, nil
+}
+
+// validate checks that the dates of an entry are in RFC 3339 format
+func (entry *PublicKeyEntry) validate() error {
+	for _, date := range []string{entry.Created, entry.Expires} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, date); err != nil {
+			return NewSaggyErrorWithMeta("Dates in the public keys file must be in RFC 3339 format, e.g. 2006-01-02T15:04:05Z", err, struct{ Date string }{Date: date})
+		}
+	}
+	return nil
+}
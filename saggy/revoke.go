@@ -0,0 +1,146 @@
+package saggy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+type RevokeResult struct {
+	KeyName   string
+	PublicKey string
+
+	// The files that were re-encrypted without the revoked key
+	Reencrypted []string
+
+	// The files whose metadata still lists the revoked key, and so remain readable with it
+	StillListed []string
+}
+
+// reencryptFile decrypts a file and encrypts it again from scratch, with a new data key
+func reencryptFile(keys *Keys, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return NewSaggyError("Failed to read file", err)
+	}
+
+	format := sopsFormatForPath(path)
+	plaintext, err := SopsDecrypt(keys.DecryptKey, data, format, path)
+	if err != nil {
+		return err
+	}
+	encryptKeys, err := keys.EncryptKeys.forPath(path)
+	if err != nil {
+		return err
+	}
+	output, err := SopsEncrypt(encryptKeys, plaintext, format, "")
+	if err != nil {
+		return err
+	}
+
+	return NewSafeWholeFile(path, os.O_RDWR, 0644).Write(output)
+}
+
+// Revoke removes the named key from the public keys file and re-encrypts every target without it
+//
+// Every file is re-encrypted with a new data key, as the holder of the revoked key may have kept the old ones.
+// Files which cannot be re-encrypted are not fatal; instead they are reported in StillListed.
+func Revoke(keys *Keys, keyName string, targets []string) (*RevokeResult, error) {
+	// Update the public keys file first so that nothing new is encrypted for the revoked key
+	var entries map[string]*PublicKeyEntry
+	var revocations []*Revocation
+	var revokedPublicKey string
+	revokedBy, signingKey := keys.DecryptKey.revoker()
+	err := updatePublicKeysFile(keys.EncryptKeys.publicKeysFilepath, func(current map[string]*PublicKeyEntry, revoked *[]*Revocation) error {
+		if err := checkRemovable(current, keyName, keys.EncryptKeys.rules); err != nil {
+			return err
+		}
+		revokedPublicKey = current[keyName].PublicKey
+
+		// Recorded as revoked, so that restoring the entry from an older public keys file does not undo this
+		by := ""
+		for name, entry := range current {
+			if name != keyName && normaliseRecipient(entry.PublicKey) == revokedBy {
+				by = name
+			}
+		}
+		if by == "" {
+			signingKey = nil
+		}
+		*revoked = revokeKey(*revoked, revokedPublicKey, by, signingKey)
+
+		delete(current, keyName)
+		dropEndorsementsBy(current, keyName)
+		entries = current
+		revocations = *revoked
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	publicKeys := publicKeysByName(entries)
+	updatedKeys := &Keys{
+		EncryptKeys: &EncryptKeys{
+			publicKeys:         &publicKeys,
+			publicKeysFilepath: keys.EncryptKeys.publicKeysFilepath,
+			entries:            entries,
+			rules:              keys.EncryptKeys.rules,
+			trustedFrom:        keys.EncryptKeys.trustedFrom,
+			revocations:        revocations,
+			revoked:            revokedNames(entries, revocations),
+			unendorsed:         keys.EncryptKeys.trustFor(entries),
+			expired:            expiredKeys(entries, time.Now()),
+		},
+		DecryptKey: keys.DecryptKey,
+	}
+
+	result := &RevokeResult{
+		KeyName:     keyName,
+		PublicKey:   revokedPublicKey,
+		Reencrypted: []string{},
+		StillListed: []string{},
+	}
+
+	err = walkEncryptedTargets(targets, func(path string) error {
+		if err := reencryptFile(updatedKeys, path); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to re-encrypt "+path+":", err)
+		} else {
+			result.Reencrypted = append(result.Reencrypted, path)
+		}
+
+		tree, _, err := loadSopsFile(path)
+		if err != nil {
+			return err
+		}
+		for _, recipient := range sopsRecipients(tree) {
+			if recipient == normaliseRecipient(revokedPublicKey) {
+				result.StillListed = append(result.StillListed, path)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if len(result.StillListed) > 0 {
+		return result, NewSaggyErrorWithMeta("Some files are still encrypted for the revoked key", nil, struct{ Files []string }{Files: result.StillListed})
+	}
+	return result, nil
+}
+
+// printRevokeResult writes a summary of which files were re-encrypted and which still list the revoked key
+func printRevokeResult(w io.Writer, result *RevokeResult) {
+	if result == nil {
+		return
+	}
+	fmt.Fprintf(w, "revoked %s %s\n", result.KeyName, result.PublicKey)
+	for _, path := range result.Reencrypted {
+		fmt.Fprintf(w, "re-encrypted %s\n", path)
+	}
+	for _, path := range result.StillListed {
+		fmt.Fprintf(w, "still readable by %s %s\n", result.KeyName, path)
+	}
+}
@@ -0,0 +1,153 @@
+package saggy
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Revocation records that a key was revoked or rotated away, so that restoring its old entry does not undo it
+//
+// Endorsements are signed per entry, so an old entry restored from history still carries endorsements that
+// verify. A revoked key is never encrypted for, whatever its entry says.
+type Revocation struct {
+	// The revoked age or SSH public key
+	PublicKey string `json:"publicKey"`
+
+	// The name of the key that revoked it, or of the key that replaced it when it was rotated away
+	// Optional; missing if whoever revoked it has no key in the public keys file
+	By string `json:"by,omitempty"`
+
+	// When the key was revoked, in RFC 3339 format
+	Revoked string `json:"revoked"`
+
+	// The signature over the canonical form of the revocation, made with By's signing key, base64 encoded
+	// Optional; missing if By has no signing key, such as an SSH key
+	Signature string `json:"signature,omitempty"`
+}
+
+// canonicalRevocation is what a revocation's signature signs: everything about it other than the signature
+func canonicalRevocation(revocation *Revocation) []byte {
+	canonical := *revocation
+	canonical.PublicKey = normaliseRecipient(revocation.PublicKey)
+	canonical.Signature = ""
+	data, _ := json.Marshal(&canonical)
+	return append([]byte("saggy revocation v1\n"), data...)
+}
+
+// revokeKey adds the public key to the keys revoked, signed by whoever revoked it if they have a signing key
+// A key that is already revoked is left as it was.
+func revokeKey(revoked []*Revocation, publicKey, by string, signingKey ed25519.PrivateKey) []*Revocation {
+	publicKey = normaliseRecipient(publicKey)
+	for _, revocation := range revoked {
+		if normaliseRecipient(revocation.PublicKey) == publicKey {
+			return revoked
+		}
+	}
+
+	revocation := &Revocation{
+		PublicKey: publicKey,
+		By:        by,
+		Revoked:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if signingKey != nil {
+		revocation.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, canonicalRevocation(revocation)))
+	}
+	return append(revoked, revocation)
+}
+
+// revoker is the public key of this host's key, and its signing key if it has one, for signing a revocation
+func (decryptKey *DecryptKey) revoker() (string, ed25519.PrivateKey) {
+	if decryptKey == nil {
+		return "", nil
+	}
+	recipient, err := decryptKey.recipient()
+	if err != nil {
+		return "", nil
+	}
+	if decryptKey.isSSH() {
+		return recipient, nil
+	}
+	signingKey, err := decryptKey.signingKey()
+	if err != nil {
+		return recipient, nil
+	}
+	return recipient, signingKey
+}
+
+// revokedNames finds the entries whose keys have been revoked, either in the public keys file or as recorded here
+//
+// A revocation is honoured whoever signed it, as it can only ever stop a key being encrypted for. The record
+// kept here means stripping a revocation from the public keys file does not undo it on hosts that have seen it.
+func revokedNames(entries map[string]*PublicKeyEntry, revoked []*Revocation) map[string]bool {
+	names := make(map[string]bool)
+	for name, entry := range entries {
+		if isRevoked(revoked, entry.PublicKey) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// isRevoked checks whether the public key has been revoked, either in the public keys file or as recorded here
+func isRevoked(revoked []*Revocation, publicKey string) bool {
+	publicKey = normaliseRecipient(publicKey)
+	for _, revocation := range revoked {
+		if normaliseRecipient(revocation.PublicKey) == publicKey {
+			return true
+		}
+	}
+	return revocationRecorded(publicKey)
+}
+
+// configRecordPath is where a record named for the given value is kept in the user's config directory
+func configRecordPath(kind, value string) (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(value))
+	return filepath.Join(configDir, "saggy", kind, hex.EncodeToString(sum[:])), nil
+}
+
+// writeConfigRecord creates the record, unless it already exists
+func writeConfigRecord(path, content string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content), 0600)
+}
+
+// recordRevocations notes here every key the public keys file revokes, so that they stay revoked
+// It is only called when endorsing or encrypting; failing to record is warned about rather than fatal.
+func recordRevocations(revoked []*Revocation) {
+	for _, revocation := range revoked {
+		publicKey := normaliseRecipient(revocation.PublicKey)
+		path, err := configRecordPath("revoked", publicKey)
+		if err == nil {
+			err = writeConfigRecord(path, publicKey+" was revoked by "+revocation.By+"; it is never encrypted for again\n")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: failed to record that "+publicKey+" is revoked:", err)
+		}
+	}
+}
+
+// revocationRecorded checks whether the public key has been seen revoked here
+func revocationRecorded(publicKey string) bool {
+	path, err := configRecordPath("revoked", normaliseRecipient(publicKey))
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
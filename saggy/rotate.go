@@ -0,0 +1,241 @@
+package saggy
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"time"
+
+	"filippo.io/age"
+)
+
+type rotateTarget struct {
+	path      string
+	format    string
+	plaintext []byte
+}
+
+// collectRotateTargets decrypts every target into memory, expanding folders into their encrypted files
+func collectRotateTargets(key *DecryptKey, targets []string) ([]*rotateTarget, error) {
+	collected := []*rotateTarget{}
+
+	collect := func(path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return NewSaggyError("Failed to read file", err)
+		}
+		format := sopsFormatForPath(path)
+		plaintext, err := SopsDecrypt(key, data, format, path)
+		if err != nil {
+			return NewSaggyErrorWithMeta("Failed to decrypt file", err, struct{ Path string }{Path: path})
+		}
+		collected = append(collected, &rotateTarget{path: path, format: format, plaintext: plaintext})
+		return nil
+	}
+
+	if err := walkEncryptedTargets(targets, collect); err != nil {
+		return nil, err
+	}
+
+	return collected, nil
+}
+
+// RotateResult is what changed in the public keys file when a key was rotated
+type RotateResult struct {
+	KeyName string
+
+	// Whether the new key has to be endorsed again, as the entry it replaced had no signing key to vouch for it with
+	NeedsEndorsing bool
+}
+
+// Rotate replaces this host's key with a new one and re-encrypts every target for the updated recipients
+//
+// The targets are all decrypted before anything is written, then the new key is recorded in the public keys file,
+// and the old private key is only replaced once every target has been re-encrypted. Until then the new private key
+// is kept alongside it with a .new suffix, which a retry picks up again and decrypts with alongside the old key.
+// The old key vouches for the new entry, so whoever trusted it trusts the new key without endorsing it again.
+func Rotate(keys *Keys, keyName string, targets []string) (*RotateResult, error) {
+	if len(targets) == 0 {
+		return nil, NewSaggyError("Nothing provided to rotate", nil)
+	}
+	if keyName == "" {
+		return nil, NewSaggyError("Key name is not set", nil)
+	}
+
+	privateKeyFilepath := keys.DecryptKey.privateKeyFilepath
+	publicKeysFilepath := keys.EncryptKeys.publicKeysFilepath
+	newPrivateKeyFilepath := privateKeyFilepath + ".new"
+
+	if keys.DecryptKey.isSSH() {
+		return nil, NewSaggyError("SSH keys cannot be rotated by saggy; create a new SSH key and import it with keygen --ssh instead", nil)
+	}
+	// Replacing the key file would lose any other keys held alongside this one
+	for _, other := range keys.DecryptKey.others {
+		if other.privateKeyFilepath == privateKeyFilepath {
+			return nil, NewSaggyErrorWithMeta("The private key file holds more than one key; rotate cannot replace just one of them", nil, struct{ Path string }{Path: privateKeyFilepath})
+		}
+	}
+	oldIdentity, err := age.ParseX25519Identity(keys.DecryptKey.privateKey)
+	if err != nil {
+		return nil, NewSaggyError("Failed to parse the current private key", err)
+	}
+	oldPublicKey := oldIdentity.Recipient().String()
+
+	// A new key left by an earlier rotation that did not finish is used again, as targets may already be encrypted for it
+	var newKey *DecryptKey
+	decryptKey := keys.DecryptKey
+	if _, err := os.Stat(newPrivateKeyFilepath); err == nil {
+		if newKey, err = readRotatedKey(newPrivateKeyFilepath, keys.DecryptKey.passphrase); err != nil {
+			return nil, NewSaggyErrorWithMeta("Failed to read the new key left by an earlier rotation; if no target has been re-encrypted for it, remove it to start again", err, struct{ Path string }{Path: newPrivateKeyFilepath})
+		}
+		fmt.Fprintln(os.Stderr, "Resuming with the new key left by an earlier rotation at "+newPrivateKeyFilepath)
+		withNewKey := *keys.DecryptKey
+		withNewKey.others = append(append([]*DecryptKey{}, keys.DecryptKey.others...), newKey)
+		decryptKey = &withNewKey
+	}
+
+	// Decrypt everything up front so that nothing is rewritten if any target is unreadable
+	collected, err := collectRotateTargets(decryptKey, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate the new key next to the current one
+	if newKey == nil {
+		if err := KeyGen_parameterised(&KeyGenParameters{
+			privateKeyFilepath: newPrivateKeyFilepath,
+			privateKeyFormat:   "age",
+			passphrase:         keys.DecryptKey.passphrase,
+		}); err != nil {
+			return nil, NewSaggyErrorWithMeta("Failed to generate the new key", err, struct{ Path string }{Path: newPrivateKeyFilepath})
+		}
+		if newKey, err = readRotatedKey(newPrivateKeyFilepath, keys.DecryptKey.passphrase); err != nil {
+			return nil, err
+		}
+	}
+	newPublicKey, err := newKey.recipient()
+	if err != nil {
+		return nil, err
+	}
+	oldSigningKey, err := keys.DecryptKey.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	newSigningKey, err := newKey.signingKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the new key before any target is encrypted for it, so that every target stays readable by the others
+	result := &RotateResult{KeyName: keyName}
+	var encryptKeys *EncryptKeys
+	err = updatePublicKeysFile(publicKeysFilepath, func(entries map[string]*PublicKeyEntry, revoked *[]*Revocation) error {
+		// An earlier rotation may have recorded the new key already
+		if existing, ok := entries[keyName]; !ok || normaliseRecipient(existing.PublicKey) != newPublicKey {
+			// The new key keeps what was recorded about the old one, other than when it was created and who vouches for it
+			entry := &PublicKeyEntry{}
+			if ok {
+				*entry = *existing
+				entry.Endorsements = nil
+				entry.RotatedFrom = nil
+			}
+			entry.PublicKey = newPublicKey
+			entry.Created = time.Now().UTC().Format(time.RFC3339)
+			entry.SigningKey = formatSigningKey(newSigningKey)
+			if err := entry.validate(); err != nil {
+				return err
+			}
+
+			// The endorsements the old key made are signed again with the new one, so that it still vouches for the same keys
+			reendorse(entries, keyName, oldSigningKey.Public().(ed25519.PublicKey), newSigningKey)
+
+			// Once endorsements are checked, the old key vouches for the new entry, which it can only do if its signing
+			// key was recorded to check it with
+			if requireEndorsements || isSigned(entries) {
+				if ok && existing.SigningKey == formatSigningKey(oldSigningKey) {
+					entry.rotateFrom(keyName, existing, oldSigningKey)
+				} else {
+					result.NeedsEndorsing = true
+				}
+			}
+			entries[keyName] = entry
+		}
+
+		// The old key may be registered under another name than this host's key name
+		for name, entry := range entries {
+			if name != keyName && normaliseRecipient(entry.PublicKey) == oldPublicKey {
+				delete(entries, name)
+			}
+		}
+
+		// The old key is rotated away for good, so that restoring its entry from an older public keys file does not bring it back
+		*revoked = revokeKey(*revoked, oldPublicKey, keyName, newSigningKey)
+
+		// The new key is this host's own, so is trusted whether or not anyone has endorsed it yet
+		unendorsed := keys.EncryptKeys.trustFor(entries)
+		delete(unendorsed, keyName)
+
+		publicKeys := publicKeysByName(entries)
+		encryptKeys = &EncryptKeys{
+			publicKeys:         &publicKeys,
+			publicKeysFilepath: publicKeysFilepath,
+			entries:            entries,
+			rules:              keys.EncryptKeys.rules,
+			trustedFrom:        keys.EncryptKeys.trustedFrom,
+			revocations:        *revoked,
+			revoked:            revokedNames(entries, *revoked),
+			unendorsed:         unendorsed,
+			expired:            expiredKeys(entries, time.Now()),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, NewSaggyErrorWithMeta("Failed to record the new key; it has been kept, and is used again when rotate is retried", err, struct{ NewKey string }{NewKey: newPrivateKeyFilepath})
+	}
+
+	// Re-encrypt every target for the new recipients
+	for _, target := range collected {
+		targetKeys, err := encryptKeys.forPath(target.path)
+		if err != nil {
+			return nil, err
+		}
+		output, err := SopsEncrypt(targetKeys, target.plaintext, target.format, "")
+		if err != nil {
+			return nil, NewSaggyErrorWithMeta("Failed to encrypt file; the new key has been kept, and is used again when rotate is retried", err, struct {
+				Path   string
+				NewKey string
+			}{Path: target.path, NewKey: newPrivateKeyFilepath})
+		}
+		if err := NewSafeWholeFile(target.path, os.O_RDWR, 0644).Write(output); err != nil {
+			return nil, NewSaggyErrorWithMeta("Failed to write encrypted file; the new key has been kept, and is used again when rotate is retried", err, struct {
+				Path   string
+				NewKey string
+			}{Path: target.path, NewKey: newPrivateKeyFilepath})
+		}
+	}
+
+	// Only now that every target has been rewritten can the old key go
+	if err := os.Rename(newPrivateKeyFilepath, privateKeyFilepath); err != nil {
+		return nil, NewSaggyError("Failed to replace the private key", err)
+	}
+
+	return result, nil
+}
+
+// readRotatedKey reads the newly generated private key, unlocking it with the passphrase of the key it replaces
+func readRotatedKey(privateKeyFilepath, passphrase string) (*DecryptKey, error) {
+	data, err := os.ReadFile(privateKeyFilepath)
+	if err != nil {
+		return nil, NewSaggyError("Failed to read the new private key", err)
+	}
+	if isPassphraseProtected(data) {
+		if data, err = decryptWithPassphrase(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	newKey := &DecryptKey{}
+	if err := newKey.parse(privateKeyFilepath, data, passphrase); err != nil {
+		return nil, err
+	}
+	return newKey, nil
+}
@@ -0,0 +1,305 @@
+package saggy
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RecipientRule restricts which keys the secrets matching a path are encrypted for
+type RecipientRule struct {
+	// A glob matched against the path of the secret relative to the config file, without any .sops parts
+	// * matches within a single directory, and ** matches any number of directories
+	Path string `yaml:"path"`
+
+	// The groups and key names to encrypt for
+	// Optional; if not provided every key is used
+	Recipients []string `yaml:"recipients"`
+}
+
+// recipientRules are the groups and rules from the config file, with the directory the rules are relative to
+type recipientRules struct {
+	dir    string
+	groups map[string][]string
+	rules  []*RecipientRule
+}
+
+// validate checks that every pattern is well formed, and that no group shares its name with a key
+func (rules *recipientRules) validate(entries map[string]*PublicKeyEntry) error {
+	for _, rule := range rules.rules {
+		if rule.Path == "" {
+			return NewSaggyError("Every rule needs a path", nil)
+		}
+		for _, segment := range strings.Split(rule.Path, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return NewSaggyErrorWithMeta("Invalid path in rule", err, struct{ Path string }{Path: rule.Path})
+			}
+		}
+	}
+	groups := []string{}
+	for group := range rules.groups {
+		groups = append(groups, group)
+	}
+	for _, entry := range entries {
+		groups = append(groups, entry.Groups...)
+	}
+	for _, group := range groups {
+		if _, ok := entries[group]; ok {
+			return NewSaggyErrorWithMeta("A group has the same name as a key", nil, struct{ Name string }{Name: group})
+		}
+	}
+	return nil
+}
+
+// match finds the first rule for the path of an encrypted file; nil if no rule matches
+func (rules *recipientRules) match(encryptedPath string) (*RecipientRule, error) {
+	if rules == nil || len(rules.rules) == 0 {
+		return nil, nil
+	}
+
+	absPath, err := filepath.Abs(encryptedPath)
+	if err != nil {
+		return nil, NewSaggyErrorWithMeta("Failed to resolve path", err, struct{ Path string }{Path: encryptedPath})
+	}
+	relPath, err := filepath.Rel(rules.dir, absPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		// Files outside the project are not covered by its rules
+		return nil, nil
+	}
+	relPath = unsopsifyPath(filepath.ToSlash(relPath))
+
+	for _, rule := range rules.rules {
+		if matchGlob(rule.Path, relPath) {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// unsopsifyPath drops the .sops parts from every element of a slash separated path, e.g. prod.sops/db.sops.yaml -> prod/db.yaml
+func unsopsifyPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		if i == len(parts)-1 {
+			parts[i] = unsopsifyFilename(parts[i])
+		} else {
+			parts[i] = unsopsifyDirectory(parts[i])
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// matchGlob matches a slash separated path against a pattern, where ** matches any number of directories
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// useRules checks the rules against the public keys, and then encrypts by them
+func (encryptKeys *EncryptKeys) useRules(rules *recipientRules) error {
+	if rules == nil {
+		return nil
+	}
+	if err := rules.validate(encryptKeys.entries); err != nil {
+		return err
+	}
+	encryptKeys.rules = rules
+	return nil
+}
+
+// naming lists the paths of the rules which name the key directly, rather than through a group
+func (rules *recipientRules) naming(keyName string) []string {
+	paths := []string{}
+	if rules == nil {
+		return paths
+	}
+	for _, rule := range rules.rules {
+		for _, name := range rule.Recipients {
+			if name == keyName {
+				paths = append(paths, rule.Path)
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// groupMembers lists the keys in a group, whether they are listed by the config file or by their own entries
+func (encryptKeys *EncryptKeys) groupMembers(group string) ([]string, bool) {
+	members, inConfig := encryptKeys.rules.groups[group]
+	fromEntries := entriesInGroup(encryptKeys.entries, group)
+	return append(append([]string{}, members...), fromEntries...), inConfig || len(fromEntries) > 0
+}
+
+// forPath narrows the public keys to those the rules choose for the encrypted file
+//
+// Without a matching rule every key is used. Members of a group which are not in the public keys file are
+// skipped, so that revoking a key does not break the groups it was in; any other unknown name is an error.
+func (encryptKeys *EncryptKeys) forPath(encryptedPath string) (*EncryptKeys, error) {
+	rule, err := encryptKeys.rules.match(encryptedPath)
+	if err != nil || rule == nil || len(rule.Recipients) == 0 {
+		return encryptKeys, err
+	}
+
+	publicKeys := make(map[string]string)
+	for _, name := range rule.Recipients {
+		if members, ok := encryptKeys.groupMembers(name); ok {
+			for _, member := range members {
+				if publicKey, ok := (*encryptKeys.publicKeys)[member]; ok {
+					publicKeys[member] = publicKey
+				}
+			}
+		} else if publicKey, ok := (*encryptKeys.publicKeys)[name]; ok {
+			publicKeys[name] = publicKey
+		} else {
+			return nil, NewSaggyErrorWithMeta("Unknown group or key in rule", nil, struct {
+				Rule string
+				Name string
+			}{Rule: rule.Path, Name: name})
+		}
+	}
+	if len(publicKeys) == 0 {
+		return nil, NewSaggyErrorWithMeta("No public keys to encrypt for; the rule matches no keys", nil, struct {
+			Rule string
+			Path string
+		}{Rule: rule.Path, Path: encryptedPath})
+	}
+
+	return &EncryptKeys{
+		publicKeys:         &publicKeys,
+		publicKeysFilepath: encryptKeys.publicKeysFilepath,
+		trustedFrom:        encryptKeys.trustedFrom,
+		revocations:        encryptKeys.revocations,
+		revoked:            encryptKeys.revoked,
+		unendorsed:         encryptKeys.unendorsed,
+		expired:            encryptKeys.expired,
+	}, nil
+}
+
+// CheckResult is how the recipients of an encrypted file differ from those its rule asks for
+type CheckResult struct {
+	Path string
+
+	// The rule the file falls under; empty if every key is expected
+	Rule string
+
+	// Recipients the rule asks for which the file is not encrypted for
+	Missing []string
+
+	// Recipients the file is encrypted for which the rule does not ask for
+	Unexpected []string
+}
+
+func (result *CheckResult) Matches() bool {
+	return len(result.Missing) == 0 && len(result.Unexpected) == 0
+}
+
+// Check compares the recipients of every encrypted file in the targets with those its rule asks for
+//
+// Nothing is decrypted or written, so no private key is needed.
+func Check(keys *EncryptKeys, targets []string) ([]*CheckResult, error) {
+	results := []*CheckResult{}
+	mismatched := []string{}
+	err := walkEncryptedTargets(targets, func(path string) error {
+		rule, err := keys.rules.match(path)
+		if err != nil {
+			return err
+		}
+		wantedKeys, err := keys.forPath(path)
+		if err != nil {
+			return err
+		}
+		tree, _, err := loadSopsFile(path)
+		if err != nil {
+			return err
+		}
+
+		result := &CheckResult{Path: path, Missing: []string{}, Unexpected: []string{}}
+		if rule != nil {
+			result.Rule = rule.Path
+		}
+		wanted := make(map[string]bool)
+		for _, recipient := range wantedKeys.recipients() {
+			wanted[recipient] = true
+		}
+		actual := make(map[string]bool)
+		for _, recipient := range sopsRecipients(tree) {
+			actual[recipient] = true
+			if !wanted[recipient] {
+				result.Unexpected = append(result.Unexpected, recipient)
+			}
+		}
+		for _, recipient := range wantedKeys.recipients() {
+			if !actual[recipient] {
+				result.Missing = append(result.Missing, recipient)
+			}
+		}
+		sort.Strings(result.Unexpected)
+
+		if !result.Matches() {
+			mismatched = append(mismatched, path)
+		}
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+
+	if len(mismatched) > 0 {
+		return results, NewSaggyErrorWithMeta("Some files are not encrypted for the recipients their rule asks for", nil, struct{ Files []string }{Files: mismatched})
+	}
+	return results, nil
+}
+
+// printCheckResults writes whether each file matches its rule, and any recipients that differ
+func printCheckResults(w io.Writer, encryptKeys *EncryptKeys, results []*CheckResult) {
+	names := encryptKeys.recipientNames()
+	describe := func(recipient string) string {
+		if name, ok := names[recipient]; ok {
+			return name + " " + recipient
+		}
+		return recipient
+	}
+
+	for _, result := range results {
+		status := "ok"
+		if !result.Matches() {
+			status = "mismatched"
+		}
+		rule := "every key"
+		if result.Rule != "" {
+			rule = "rule " + result.Rule
+		}
+		fmt.Fprintf(w, "%s %s (%s)\n", status, result.Path, rule)
+		for _, recipient := range result.Missing {
+			fmt.Fprintf(w, "\t+ %s\n", describe(recipient))
+		}
+		for _, recipient := range result.Unexpected {
+			fmt.Fprintf(w, "\t- %s\n", describe(recipient))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package saggy
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// The signals passed on to a running command rather than stopping saggy
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// catchSignals stops the forwarded signals from killing saggy, so that deferred cleanup always runs
+// The returned function must be called to restore the default behaviour
+func catchSignals() (<-chan os.Signal, func()) {
+	signals := make(chan os.Signal, len(forwardedSignals))
+	signal.Notify(signals, forwardedSignals...)
+	return signals, func() { signal.Stop(signals) }
+}
+
+// signalExitCode is the exit code a shell would report for a process killed by the signal
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// exitCode is the exit code of a finished command, using 128+n when it was killed by signal n
+func exitCode(cmd *exec.Cmd) int {
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return signalExitCode(status.Signal())
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// forwardSignals passes every caught signal on to the command until done is closed
+func forwardSignals(cmd *exec.Cmd, signals <-chan os.Signal, done <-chan struct{}) {
+	for {
+		select {
+		case sig := <-signals:
+			cmd.Process.Signal(sig)
+		case <-done:
+			return
+		}
+	}
+}
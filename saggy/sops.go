@@ -0,0 +1,381 @@
+package saggy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/version"
+)
+
+// sopsFormatForPath determines the sops format (binary, dotenv, ini, json or yaml) from a filename
+func sopsFormatForPath(path string) string {
+	switch formats.FormatForPath(path) {
+	case formats.Dotenv:
+		return "dotenv"
+	case formats.Ini:
+		return "ini"
+	case formats.Json:
+		return "json"
+	case formats.Yaml:
+		return "yaml"
+	default:
+		return "binary"
+	}
+}
+
+func sopsStoreForFormat(format string) common.Store {
+	return common.StoreForFormat(formats.FormatFromString(format), config.NewStoresConfig())
+}
+
+// recipients returns the public keys in a stable order
+func (encryptKeys *EncryptKeys) recipients() []string {
+	ageKeys := []string{}
+	if encryptKeys == nil || encryptKeys.publicKeys == nil {
+		return ageKeys
+	}
+	for _, key := range *encryptKeys.publicKeys {
+		ageKeys = append(ageKeys, normaliseRecipient(key))
+	}
+	sort.Strings(ageKeys)
+	return ageKeys
+}
+
+// hasSSHRecipients checks whether any of the public keys are SSH keys
+func (encryptKeys *EncryptKeys) hasSSHRecipients() bool {
+	for _, recipient := range encryptKeys.recipients() {
+		if isSSHRecipient(recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientNames maps each public key to the name it is registered under
+func (encryptKeys *EncryptKeys) recipientNames() map[string]string {
+	names := make(map[string]string)
+	if encryptKeys == nil || encryptKeys.publicKeys == nil {
+		return names
+	}
+	for name, key := range *encryptKeys.publicKeys {
+		names[normaliseRecipient(key)] = name
+	}
+	return names
+}
+
+// sopsInput is the file to give the sops binary: the real path where there is one, so that any creation rules
+// match against it, and otherwise stdin
+func sopsInput(path string, r io.Reader) (string, io.Reader) {
+	if path != "" {
+		return path, nil
+	}
+	return "/dev/stdin", r
+}
+
+// sopsNeedsImport checks whether data without a path has to be handled in-process, as there is no /dev/stdin to give sops
+func sopsNeedsImport(path string) bool {
+	return path == "" && runtime.GOOS == "windows"
+}
+
+func Sops_encrypt_via_path(keys *EncryptKeys, path string, data []byte, format string) ([]byte, error) {
+	input, stdin := sopsInput(path, bytes.NewReader(data))
+	args := []string{"--encrypt", "--age", strings.Join(keys.recipients(), ",")}
+	args = append(args, "--input-type", format, "--output-type", format, input)
+	cmd := exec.Command("sops", args...)
+	cmd.Stdin = stdin
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, NewCommandError("Failed to encrypt", string(output), cmd)
+	}
+	return output, nil
+}
+
+func Sops_encrypt_via_import(keys *EncryptKeys, data []byte, format string) ([]byte, error) {
+	store := sopsStoreForFormat(format)
+
+	branches, err := store.LoadPlainFile(data)
+	if err != nil {
+		return nil, NewSaggyError("Failed to parse the data to encrypt", err)
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, NewSaggyError("Failed to generate the data key", err)
+	}
+
+	// The data key is encrypted for each recipient here rather than by sops, as sops only handles age recipients
+	group := sops.KeyGroup{}
+	for _, recipient := range keys.recipients() {
+		masterKey, err := newSopsMasterKey(recipient, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		group = append(group, masterKey)
+	}
+
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups: []sops.KeyGroup{group},
+			// The same default as the sops binary, which leaves values under keys with this suffix unencrypted
+			UnencryptedSuffix: sops.DefaultUnencryptedSuffix,
+			Version:           version.Version,
+		},
+	}
+
+	if err := common.EncryptTree(common.EncryptTreeOpts{
+		DataKey: dataKey,
+		Tree:    &tree,
+		Cipher:  aes.NewCipher(),
+	}); err != nil {
+		return nil, NewSaggyError("Failed to encrypt", err)
+	}
+
+	output, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		return nil, NewSaggyError("Failed to emit the encrypted data", err)
+	}
+	return output, nil
+}
+
+// SopsEncrypt encrypts the data in the given sops format for every public key
+// path is the file the data was read from, if any; empty for data with no path
+func SopsEncrypt(keys *EncryptKeys, data []byte, format, path string) ([]byte, error) {
+	if len(keys.recipients()) == 0 {
+		return nil, NewSaggyError("No public keys to encrypt for", nil)
+	}
+	if err := keys.checkEndorsed(); err != nil {
+		return nil, err
+	}
+	keys.warnExpired()
+	keys.rememberTrust()
+
+	// The sops binary cannot encrypt for SSH keys, so they are always handled in-process
+	if useBundledDependencies || keys.hasSSHRecipients() || sopsNeedsImport(path) {
+		return Sops_encrypt_via_import(keys, data, format)
+	} else {
+		return Sops_encrypt_via_path(keys, path, data, format)
+	}
+}
+
+func Sops_encrypt_stream_via_path(keys *EncryptKeys, path string, r io.Reader, w io.Writer, format string) error {
+	input, stdin := sopsInput(path, r)
+	args := []string{"--encrypt", "--age", strings.Join(keys.recipients(), ",")}
+	args = append(args, "--input-type", format, "--output-type", format, input)
+	cmd := exec.Command("sops", args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stdin = stdin
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return NewCommandError("Failed to encrypt", stderr.String(), cmd)
+	}
+	return nil
+}
+
+// Sops_encrypt_stream_via_import has to hold the data in memory, as the whole tree is needed to encrypt it
+func Sops_encrypt_stream_via_import(keys *EncryptKeys, r io.Reader, w io.Writer, format string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return NewSaggyError("Failed to read the data to encrypt", err)
+	}
+	output, err := Sops_encrypt_via_import(keys, data, format)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(output); err != nil {
+		return NewSaggyError("Failed to write the encrypted data", err)
+	}
+	return nil
+}
+
+// SopsEncryptStream encrypts from the reader to the writer in the given sops format for every public key
+// path is the file the reader reads, if any; empty for data with no path
+func SopsEncryptStream(keys *EncryptKeys, r io.Reader, w io.Writer, format, path string) error {
+	if len(keys.recipients()) == 0 {
+		return NewSaggyError("No public keys to encrypt for", nil)
+	}
+	if err := keys.checkEndorsed(); err != nil {
+		return err
+	}
+	keys.warnExpired()
+	keys.rememberTrust()
+
+	// The sops binary cannot encrypt for SSH keys, so they are always handled in-process
+	if useBundledDependencies || keys.hasSSHRecipients() || sopsNeedsImport(path) {
+		return Sops_encrypt_stream_via_import(keys, r, w, format)
+	} else {
+		return Sops_encrypt_stream_via_path(keys, path, r, w, format)
+	}
+}
+
+func Sops_decrypt_via_path(key *DecryptKey, path string, data []byte, format string) ([]byte, error) {
+	input, stdin := sopsInput(path, bytes.NewReader(data))
+	cmd := exec.Command("sops", "--decrypt", "--input-type", format, "--output-type", format, input)
+	cmd.Env = []string{"SOPS_AGE_KEY_FILE=" + key.keyFile()}
+	cmd.Stdin = stdin
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, NewCommandError("Failed to decrypt", string(output), cmd)
+	}
+	return output, nil
+}
+
+func Sops_decrypt_via_import(key *DecryptKey, data []byte, format string) ([]byte, error) {
+	store := sopsStoreForFormat(format)
+
+	tree, err := store.LoadEncryptedFile(data)
+	if err != nil {
+		return nil, NewSaggyError("Failed to load the encrypted data", err)
+	}
+
+	dataKey, err := sopsDataKey(key, &tree)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(dataKey, cipher)
+	if err != nil {
+		return nil, NewSaggyError("Failed to decrypt", err)
+	}
+
+	// The stored MAC must match the decrypted content, otherwise the file has been tampered with
+	originalMac, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, NewSaggyError("Failed to decrypt the MAC", err)
+	}
+	if originalMac != mac {
+		return nil, NewSaggyError("Failed to verify data integrity; the MAC does not match", nil)
+	}
+
+	output, err := store.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, NewSaggyError("Failed to emit the decrypted data", err)
+	}
+	return output, nil
+}
+
+// sopsDataKey recovers the data key of a sops tree using whichever of the private keys is a recipient
+func sopsDataKey(key *DecryptKey, tree *sops.Tree) ([]byte, error) {
+	identities := sopsage.ParsedIdentities{}
+	for _, k := range key.all() {
+		identity, err := k.identity()
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	var errs []error
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, masterKey := range group {
+			ageKey, ok := masterKey.(*sopsage.MasterKey)
+			if !ok {
+				continue
+			}
+			identities.ApplyToMasterKey(ageKey)
+			dataKey, err := ageKey.Decrypt()
+			if err == nil {
+				return dataKey, nil
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, NewSaggyErrorWithMeta("Failed to decrypt the data key; none of the private keys are recipients", errs[0], sopsRecipients(tree))
+	}
+	return nil, NewSaggyError("Failed to decrypt the data key; there are no age recipients", nil)
+}
+
+// loadSopsFile loads the encrypted tree of a sops file without decrypting it
+func loadSopsFile(path string) (*sops.Tree, common.Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, NewSaggyError_skipFrames("Failed to read file", err, struct{ Path string }{Path: path}, 1)
+	}
+
+	store := sopsStoreForFormat(sopsFormatForPath(path))
+	tree, err := store.LoadEncryptedFile(data)
+	if err != nil {
+		return nil, nil, NewSaggyError_skipFrames("Failed to load the encrypted file", err, struct{ Path string }{Path: path}, 1)
+	}
+	return &tree, store, nil
+}
+
+// sopsRecipients lists the age recipients recorded in the metadata of a sops tree
+func sopsRecipients(tree *sops.Tree) []string {
+	recipients := []string{}
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, masterKey := range group {
+			if masterKey.TypeToIdentifier() == sopsage.KeyTypeIdentifier {
+				recipients = append(recipients, masterKey.ToString())
+			}
+		}
+	}
+	return recipients
+}
+
+// SopsDecrypt decrypts the data in the given sops format using the private key
+// path is the file the data was read from, if any; empty for data with no path
+func SopsDecrypt(key *DecryptKey, data []byte, format, path string) ([]byte, error) {
+	// The sops binary can only be given a single unprotected age key file; anything else is handled in-process
+	if useBundledDependencies || key.keyFile() == "" || sopsNeedsImport(path) {
+		return Sops_decrypt_via_import(key, data, format)
+	} else {
+		return Sops_decrypt_via_path(key, path, data, format)
+	}
+}
+
+func Sops_decrypt_stream_via_path(key *DecryptKey, path string, r io.Reader, w io.Writer, format string) error {
+	input, stdin := sopsInput(path, r)
+	cmd := exec.Command("sops", "--decrypt", "--input-type", format, "--output-type", format, input)
+	cmd.Env = []string{"SOPS_AGE_KEY_FILE=" + key.keyFile()}
+	stderr := &bytes.Buffer{}
+	cmd.Stdin = stdin
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return NewCommandError("Failed to decrypt", stderr.String(), cmd)
+	}
+	return nil
+}
+
+// Sops_decrypt_stream_via_import has to hold the data in memory, as the whole tree is needed to check the MAC
+func Sops_decrypt_stream_via_import(key *DecryptKey, r io.Reader, w io.Writer, format string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return NewSaggyError("Failed to read the data to decrypt", err)
+	}
+	output, err := Sops_decrypt_via_import(key, data, format)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(output); err != nil {
+		return NewSaggyError("Failed to write the decrypted data", err)
+	}
+	return nil
+}
+
+// SopsDecryptStream decrypts from the reader to the writer in the given sops format using the private key
+// path is the file the reader reads, if any; empty for data with no path
+func SopsDecryptStream(key *DecryptKey, r io.Reader, w io.Writer, format, path string) error {
+	// The sops binary can only be given a single unprotected age key file; anything else is handled in-process
+	if useBundledDependencies || key.keyFile() == "" || sopsNeedsImport(path) {
+		return Sops_decrypt_stream_via_import(key, r, w, format)
+	} else {
+		return Sops_decrypt_stream_via_path(key, path, r, w, format)
+	}
+}
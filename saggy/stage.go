@@ -0,0 +1,204 @@
+package saggy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stageFolder builds a complete replacement for the folder alongside it, then swaps it in
+//
+// The stage starts as a copy of whatever is already in the folder, so files that build does not
+// write are kept. If build fails, or the swap fails, the original folder is left untouched.
+// A folder that does not exist yet is given perms; an existing one keeps its own.
+func stageFolder(to string, perms fs.FileMode, build func(stage string) error) error {
+	to = filepath.Clean(to)
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return NewSaggyError("Failed to create parent directories", err)
+	}
+	if err := recoverFolderBackup(to); err != nil {
+		return err
+	}
+
+	stage, err := safeCreateRelativeTempDir(to, 0700)
+	if err != nil {
+		return NewSaggyErrorWithMeta("Failed to create staging directory", err, struct{ Path string }{Path: to})
+	}
+	defer os.RemoveAll(stage)
+
+	mode := perms
+	info, err := os.Stat(to)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return NewSaggyError("Failed to stat directory", err)
+	} else if err == nil {
+		if !info.IsDir() {
+			return NewSaggyErrorWithMeta("Destination already exists and is not a directory", nil, struct{ Path string }{Path: to})
+		}
+		mode = info.Mode().Perm()
+		if err := copyTree(to, stage); err != nil {
+			return NewSaggyErrorWithMeta("Failed to copy the existing directory", err, struct{ Path string }{Path: to})
+		}
+	}
+
+	if err := build(stage); err != nil {
+		return err
+	}
+	if err := os.Chmod(stage, mode); err != nil {
+		return NewSaggyError("Failed to set directory permissions", err)
+	}
+
+	return swapFolder(stage, to)
+}
+
+// folderBackupName is where swapFolder moves the original folder while the stage is renamed into place
+// It is fixed rather than random, so that an interrupted swap can be found and undone
+func folderBackupName(to string) string {
+	basename := filepath.Base(to)
+	if !strings.HasPrefix(basename, ".") {
+		basename = "." + basename
+	}
+	return filepath.Join(filepath.Dir(to), basename+".orig")
+}
+
+// recoverFolderBackup undoes a swap that was interrupted between its two renames
+// If the folder is missing its backup is moved back; if both exist the swap had finished, and the backup is removed
+func recoverFolderBackup(to string) error {
+	backup := folderBackupName(to)
+	if _, err := os.Lstat(backup); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return NewSaggyError("Failed to stat directory", err)
+	}
+
+	if _, err := os.Lstat(to); errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "Restoring "+to+" from "+backup+", left by an interrupted update")
+		if err := os.Rename(backup, to); err != nil {
+			return NewSaggyErrorWithMeta("Failed to restore the original directory", err, struct{ Original string }{Original: backup})
+		}
+		return nil
+	} else if err != nil {
+		return NewSaggyError("Failed to stat directory", err)
+	}
+
+	if err := os.RemoveAll(backup); err != nil {
+		return NewSaggyErrorWithMeta("Failed to remove the original directory", err, struct{ Path string }{Path: backup})
+	}
+	return nil
+}
+
+// swapFolder moves the staged folder into place
+//
+// Where the filesystem allows, the two are exchanged in one step. Otherwise the original is renamed
+// aside and the stage renamed into place; should the second rename fail the original is moved back,
+// and should the process be interrupted between the two, recoverFolderBackup restores it next time.
+func swapFolder(stage, to string) error {
+	if _, err := os.Lstat(to); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(stage, to); err != nil {
+			return NewSaggyError("Failed to move the staged directory into place", err)
+		}
+		return nil
+	}
+
+	// The original ends up at the stage, which the caller removes
+	if exchanged, err := exchangeFolders(stage, to); err != nil {
+		return NewSaggyError("Failed to move the staged directory into place", err)
+	} else if exchanged {
+		return nil
+	}
+
+	backup := folderBackupName(to)
+	if err := os.Rename(to, backup); err != nil {
+		return NewSaggyError("Failed to move the original directory aside", err)
+	}
+	if err := os.Rename(stage, to); err != nil {
+		if restoreErr := os.Rename(backup, to); restoreErr != nil {
+			return NewSaggyErrorWithMeta("Failed to move the staged directory into place, and to restore the original", err, struct{ Original string }{Original: backup})
+		}
+		return NewSaggyError("Failed to move the staged directory into place", err)
+	}
+
+	if err := os.RemoveAll(backup); err != nil {
+		return NewSaggyErrorWithMeta("Failed to remove the original directory", err, struct{ Path string }{Path: backup})
+	}
+	return nil
+}
+
+// copyTree copies the contents of one directory into another, keeping permissions and symlinks
+func copyTree(from, to string) error {
+	return filepath.WalkDir(from, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		target := filepath.Join(to, relPath)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(from, to string, perms fs.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perms)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// streamFile streams one file through the transform into another, creating it with perms or truncating it
+func streamFile(from, to string, perms fs.FileMode, transform func(r io.Reader, w io.Writer) error) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return NewSaggyError("Failed to read file", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perms)
+	if err != nil {
+		return NewSaggyError("Failed to create file", err)
+	}
+	if err := transform(in, out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return NewSaggyError("Failed to write file", err)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build darwin
+
+package saggy
+
+import "syscall"
+
+// Shown when no memory backed location is found, as darwin has none by default
+const memoryBackedHint = "darwin has no memory backed location by default; mount one with mount_tmpfs and set SAGGY_TMPDIR to it, or pass --allow-disk"
+
+// isMemoryBacked checks whether the path is on a filesystem held in memory, such as tmpfs
+// RAM disks made with hdiutil are formatted like any other disk, so only tmpfs can be recognised
+func isMemoryBacked(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false
+	}
+	name := make([]byte, 0, len(stat.Fstypename))
+	for _, c := range stat.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name) == "tmpfs"
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package saggy
+
+import "syscall"
+
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// Shown when no memory backed location is found
+const memoryBackedHint = "set SAGGY_TMPDIR to a tmpfs mount, or pass --allow-disk"
+
+// isMemoryBacked checks whether the path is on a filesystem held in memory, such as tmpfs
+func isMemoryBacked(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false
+	}
+	return stat.Type == tmpfsMagic || stat.Type == ramfsMagic
+}
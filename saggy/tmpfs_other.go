@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package saggy
+
+// Shown when no memory backed location is found, as nothing here can be recognised as one
+const memoryBackedHint = "this platform cannot tell whether a location is held in memory, so --allow-disk is always needed"
+
+// isMemoryBacked checks whether the path is on a filesystem held in memory, such as tmpfs
+// Only linux and darwin are able to tell; everywhere else every location is assumed to be backed by disk
+func isMemoryBacked(path string) bool {
+	return false
+}
@@ -0,0 +1,152 @@
+package saggy
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/getsops/sops/v3"
+	sopsage "github.com/getsops/sops/v3/age"
+)
+
+type UpdateKeysResult struct {
+	Path    string
+	Added   []string
+	Removed []string
+}
+
+func (result *UpdateKeysResult) Changed() bool {
+	return len(result.Added) > 0 || len(result.Removed) > 0
+}
+
+// UpdateKeys brings the recipients of every target in line with the public keys
+//
+// Only the data key is re-encrypted; the encrypted values, and therefore the MAC, are left as they are.
+// With dryRun nothing is written and the private key is not needed.
+func UpdateKeys(keys *Keys, targets []string, dryRun bool) ([]*UpdateKeysResult, error) {
+	if len(keys.EncryptKeys.recipients()) == 0 {
+		return nil, NewSaggyError("No public keys to encrypt for", nil)
+	}
+
+	results := []*UpdateKeysResult{}
+	err := walkEncryptedTargets(targets, func(path string) error {
+		result, err := updateKeysInFile(keys, path, dryRun)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+		return nil
+	})
+	return results, err
+}
+
+func updateKeysInFile(keys *Keys, path string, dryRun bool) (*UpdateKeysResult, error) {
+	tree, store, err := loadSopsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tree.Metadata.KeyGroups) > 1 {
+		return nil, NewSaggyErrorWithMeta("Files with multiple key groups are not supported", nil, struct{ Path string }{Path: path})
+	}
+
+	// Work out which recipients differ
+	wantedKeys, err := keys.EncryptKeys.forPath(path)
+	if err != nil {
+		return nil, err
+	}
+	wanted := wantedKeys.recipients()
+	isWanted := make(map[string]bool)
+	for _, recipient := range wanted {
+		isWanted[recipient] = true
+	}
+	current := make(map[string]bool)
+	for _, recipient := range sopsRecipients(tree) {
+		current[recipient] = true
+	}
+
+	result := &UpdateKeysResult{Path: path, Added: []string{}, Removed: []string{}}
+	for _, recipient := range wanted {
+		if !current[recipient] {
+			result.Added = append(result.Added, recipient)
+		}
+	}
+	for _, recipient := range sopsRecipients(tree) {
+		if !isWanted[recipient] {
+			result.Removed = append(result.Removed, recipient)
+		}
+	}
+
+	if dryRun || !result.Changed() {
+		return result, nil
+	}
+	if err := wantedKeys.checkEndorsed(); err != nil {
+		return nil, err
+	}
+	wantedKeys.warnExpired()
+	wantedKeys.rememberTrust()
+
+	if keys.DecryptKey == nil {
+		return nil, NewSaggyError("Cannot update keys - no private key provided", nil)
+	}
+	dataKey, err := sopsDataKey(keys.DecryptKey, tree)
+	if err != nil {
+		return nil, NewSaggyErrorWithMeta("Failed to recover the data key", err, struct{ Path string }{Path: path})
+	}
+
+	// Keep the existing keys that are still wanted, as well as any that are not age keys
+	group := sops.KeyGroup{}
+	for _, existingGroup := range tree.Metadata.KeyGroups {
+		for _, masterKey := range existingGroup {
+			if masterKey.TypeToIdentifier() != sopsage.KeyTypeIdentifier || isWanted[masterKey.ToString()] {
+				group = append(group, masterKey)
+			}
+		}
+	}
+
+	// Only the new recipients need the data key encrypting for them
+	for _, recipient := range result.Added {
+		masterKey, err := newSopsMasterKey(recipient, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		group = append(group, masterKey)
+	}
+	tree.Metadata.KeyGroups = []sops.KeyGroup{group}
+
+	output, err := store.EmitEncryptedFile(*tree)
+	if err != nil {
+		return nil, NewSaggyError("Failed to emit the encrypted data", err)
+	}
+	if err := NewSafeWholeFile(path, os.O_RDWR, 0644).Write(output); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// printUpdateKeysResults writes a per-file summary of the recipients added and removed
+func printUpdateKeysResults(w io.Writer, encryptKeys *EncryptKeys, results []*UpdateKeysResult, dryRun bool) {
+	names := encryptKeys.recipientNames()
+	describe := func(recipient string) string {
+		if name, ok := names[recipient]; ok {
+			return name + " " + recipient
+		}
+		return recipient
+	}
+
+	for _, result := range results {
+		status := "unchanged"
+		if result.Changed() && dryRun {
+			status = "would update"
+		} else if result.Changed() {
+			status = "updated"
+		}
+		fmt.Fprintf(w, "%s %s\n", status, result.Path)
+		for _, recipient := range result.Added {
+			fmt.Fprintf(w, "\t+ %s\n", describe(recipient))
+		}
+		for _, recipient := range result.Removed {
+			fmt.Fprintf(w, "\t- %s\n", describe(recipient))
+		}
+	}
+}
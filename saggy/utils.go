@@ -31,8 +31,8 @@ func safeCreateAbsoluteTempFile(perms fs.FileMode) (*os.File, error) {
 	}, perms)
 }
 
-// TODO: credit properly; taken and modified from go source
-func safeCreateRelativeTempFile(forFilename string, perms fs.FileMode) (*os.File, error) {
+// relativeTempName generates hidden names alongside the file, like .<basename><random>.tmp
+func relativeTempName(forFilename string) func() string {
 	dir := filepath.Dir(forFilename)
 	basename := filepath.Base(forFilename)
 
@@ -44,11 +44,31 @@ func safeCreateRelativeTempFile(forFilename string, perms fs.FileMode) (*os.File
 	}
 	suffix := ".tmp"
 
-	nextName := func() string {
+	return func() string {
 		return filepath.Join(dir, prefix+randomDecimalString()+suffix)
 	}
+}
 
-	return safeCreateTempFile(nextName, perms)
+// TODO: credit properly; taken and modified from go source
+func safeCreateRelativeTempFile(forFilename string, perms fs.FileMode) (*os.File, error) {
+	return safeCreateTempFile(relativeTempName(forFilename), perms)
+}
+
+// safeCreateRelativeTempDir creates a hidden directory alongside the given one, named as for safeCreateRelativeTempFile
+func safeCreateRelativeTempDir(forDirname string, perms fs.FileMode) (string, error) {
+	nextName := relativeTempName(forDirname)
+	try := 0
+	for {
+		name := nextName()
+		err := os.Mkdir(name, perms)
+		if errors.Is(err, fs.ErrExist) {
+			if try++; try < 10000 {
+				continue
+			}
+			return "", err
+		}
+		return name, err
+	}
 }
 
 // TODO: credit properly; taken and modified from go source
@@ -117,23 +137,84 @@ func getSopsifiedDirname(dir string) string {
 	return dir + ".sops"
 }
 
-func createTempFile() (string, error) {
-	tmpFile, err := os.CreateTemp("", "saggy")
+// secureTempDir finds somewhere to put decrypted secrets, preferring locations held in memory
+//
+// A configured directory is used if it is memory backed, or if allowDisk is set; it may come from a committed
+// config file, so it is held to the same standard. Otherwise $XDG_RUNTIME_DIR, /dev/shm and the system
+// temporary directory are tried in turn, and only used if they are memory backed. A disk backed location
+// is only used as a last resort, and only if allowDisk is set.
+func secureTempDir(configured string, allowDisk bool) (string, error) {
+	if configured != "" {
+		if !allowDisk && !isMemoryBacked(configured) {
+			return "", NewSaggyErrorWithMeta("Refusing to write decrypted secrets to disk; the configured temporary directory is not memory backed; "+memoryBackedHint, nil, struct{ Path string }{Path: configured})
+		}
+		return configured, nil
+	}
+
+	candidates := []string{}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		candidates = append(candidates, runtimeDir)
+	}
+	candidates = append(candidates, "/dev/shm", os.TempDir())
+
+	for _, candidate := range candidates {
+		if isMemoryBacked(candidate) {
+			return candidate, nil
+		}
+	}
+
+	if allowDisk {
+		return os.TempDir(), nil
+	}
+	return "", NewSaggyErrorWithMeta("Refusing to write decrypted secrets to disk; no memory backed temporary directory was found; "+memoryBackedHint, nil, struct{ Candidates []string }{Candidates: candidates})
+}
+
+func createTempFile(dir string) (string, error) {
+	tmpFile, err := os.CreateTemp(dir, "saggy")
 	if err != nil {
 		return "", NewSaggyError_skipFrames("Failed to create temporary file", err, nil, 2)
 	}
 	tmpFile.Close()
+	if err := os.Chmod(tmpFile.Name(), 0600); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", NewSaggyError_skipFrames("Failed to restrict temporary file permissions", err, nil, 2)
+	}
 	return tmpFile.Name(), nil
 }
 
-func createTempDir() (string, error) {
-	tmpDir, err := os.MkdirTemp("", "saggy")
+func createTempDir(dir string) (string, error) {
+	tmpDir, err := os.MkdirTemp(dir, "saggy")
 	if err != nil {
 		return "", NewSaggyError_skipFrames("Failed to create temporary directory", err, nil, 2)
 	}
+	if err := os.Chmod(tmpDir, 0700); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", NewSaggyError_skipFrames("Failed to restrict temporary directory permissions", err, nil, 2)
+	}
 	return tmpDir, nil
 }
 
+// shred overwrites every regular file under the path with zeros and then removes it all
+// Errors are ignored, as this is a best effort on the way out
+func shred(path string) {
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		file, err := os.OpenFile(p, os.O_WRONLY, 0)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			file.Write(make([]byte, info.Size()))
+			file.Sync()
+		}
+		return nil
+	})
+	os.RemoveAll(path)
+}
+
 func isDir(path string) (bool, error) {
 	info, err := os.Stat(path)
 	if err != nil {
@@ -146,6 +227,54 @@ func isDir(path string) (bool, error) {
 	return info.IsDir(), nil
 }
 
+// walkEncryptedTargets calls fn for every target file, and for every encrypted file within every target folder
+func walkEncryptedTargets(targets []string, fn func(path string) error) error {
+	for _, target := range targets {
+		if is_dir, err := isDir(target); err != nil {
+			return err
+		} else if !is_dir {
+			if err := fn(target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := filepath.WalkDir(filepath.Clean(target), func(path string, info os.DirEntry, err error) error {
+			if err != nil {
+				return NewSaggyError("Failed to walk directory", err)
+			}
+			if info.IsDir() || !isSopsifiedFilename(path) {
+				return nil
+			}
+			return fn(path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isValidEnvName checks the name is usable as an environment variable; a letter or underscore followed by letters, digits or underscores
+func isValidEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && i > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes a string so that a POSIX shell treats it as a single literal word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
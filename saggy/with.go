@@ -1,83 +1,370 @@
 package saggy
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/getsops/sops/v3"
 )
 
-func With(keys *Keys, target string, command []string, mode string) error {
+type WithParameters struct {
+	// The encrypted file or folder to decrypt for the duration of the command
+	// Optional; if secrets are provided
+	target string
+
+	// Named encrypted files or folders, each decrypted to its own location and substituted for {NAME}
+	// Optional; if a target is provided
+	secrets []*WithSecret
+
+	// The command to run; any token is substituted with the decrypted target
+	command []string
+
+	// The placeholder substituted with the decrypted target, like xargs -I
+	// Optional; defaults to {}
+	token string
+
+	// Either read, write or env
+	// Optional; defaults to read
+	mode string
+
+	// Prepended to the name of every variable set in env mode
+	// Optional
+	envPrefix string
+
+	// The shell used to interpret the command, e.g. sh
+	// Optional; if not provided the command is run directly without a shell
+	shell string
+
+	// Where to put the decrypted secrets
+	// Optional; if not provided a memory backed location is found
+	tmpDir string
+
+	// Whether decrypted secrets may be put on disk when no memory backed location is found
+	// Optional; defaults to false
+	allowDisk bool
+
+	// Whether to deliver decrypted files through a FIFO rather than a regular file
+	// Optional; defaults to false, and folders are always decrypted to a temporary folder
+	fifo bool
+
+	// How long to wait for the command to open each FIFO
+	// Optional; defaults to 30 seconds
+	fifoTimeout time.Duration
+}
+
+type WithSecret struct {
+	// The name used in the {NAME} placeholder
+	name string
+
+	// The encrypted file or folder
+	path string
+}
+
+// withDecrypted is a secret that has been decrypted for the duration of the command
+type withDecrypted struct {
+	placeholder string
+	path        string
+	isDir       bool
+	decrypted   string
+
+	// The outcome of writing into the FIFO; nil unless delivered through a FIFO
+	delivered <-chan error
+
+	// What was decrypted, to compare against when writing back; nil unless writing back
+	original map[string][]byte
+}
+
+// ParseWithSecret parses NAME=path as given to --secret
+func ParseWithSecret(secret string) (*WithSecret, error) {
+	name, path, found := strings.Cut(secret, "=")
+	if !found || name == "" || path == "" {
+		return nil, NewSaggyErrorWithMeta("Expected NAME=<path>", nil, struct{ Secret string }{Secret: secret})
+	}
+	if strings.ContainsAny(name, "{}") {
+		return nil, NewSaggyErrorWithMeta("Secret names cannot contain braces", nil, struct{ Name string }{Name: name})
+	}
+	return &WithSecret{name: name, path: path}, nil
+}
+
+func With(keys *Keys, parameters *WithParameters) error {
+	if parameters.mode == "" {
+		parameters.mode = "read"
+	}
+	if parameters.token == "" {
+		parameters.token = "{}"
+	}
+	mode := parameters.mode
+	if mode != "read" && mode != "write" && mode != "env" {
+		return NewSaggyError("Invalid mode", nil)
+	}
+
 	if mode == "write" && keys.publicKeys == nil {
 		return NewSaggyError("Cannot write - no public keys provided", nil)
 	}
 
-	if is_dir, err := isDir(target); err != nil {
+	if mode == "env" {
+		if len(parameters.secrets) > 0 {
+			return NewSaggyError("Cannot use named secrets when exporting environment variables", nil)
+		}
+		if parameters.fifo {
+			return NewSaggyError("Cannot use a FIFO when exporting environment variables", nil)
+		}
+		if is_dir, err := isDir(parameters.target); err != nil {
+			return err
+		} else if is_dir {
+			return NewSaggyError("Cannot export a folder as environment variables", nil)
+		}
+		return withEnv(keys, parameters.target, parameters.command, parameters.envPrefix)
+	}
+
+	// Gather everything to decrypt, along with what it is substituted for
+	targets := []*withDecrypted{}
+	if parameters.target != "" {
+		targets = append(targets, &withDecrypted{placeholder: parameters.token, path: parameters.target})
+	}
+	for _, secret := range parameters.secrets {
+		placeholder := "{" + secret.name + "}"
+		for _, existing := range targets {
+			if existing.placeholder == placeholder {
+				return NewSaggyErrorWithMeta("The same placeholder is used more than once", nil, struct{ Placeholder string }{Placeholder: placeholder})
+			}
+		}
+		targets = append(targets, &withDecrypted{placeholder: placeholder, path: secret.path})
+	}
+	if len(targets) == 0 {
+		return NewSaggyError("Nothing provided to decrypt", nil)
+	}
+
+	for _, target := range targets {
+		if is_dir, err := isDir(target.path); err != nil {
+			return err
+		} else {
+			target.isDir = is_dir
+		}
+	}
+
+	tmpDir, err := secureTempDir(parameters.tmpDir, parameters.allowDisk)
+	if err != nil {
 		return err
-	} else if is_dir {
-		return withFolder(keys, target, command, mode)
-	} else {
-		return withFile(keys, target, command, mode)
 	}
-}
 
-func withFile(keys *Keys, file string, command []string, mode string) error {
-	tmpFile, s_err := createTempFile()
-	if s_err != nil {
-		return NewSaggyError("Failed to create temporary file", s_err)
+	// From here on a signal must not stop saggy before the decrypted secrets are shredded
+	interrupted, stop := catchSignals()
+	defer stop()
+
+	// Closed once the command exits, so that FIFOs it never opened stop waiting
+	exited := make(chan struct{})
+
+	// Decrypt each target to its own temporary location
+	for _, target := range targets {
+		if target.isDir {
+			if parameters.fifo {
+				fmt.Fprintln(os.Stderr, "Folders cannot be delivered through a FIFO; decrypting "+target.path+" to a temporary folder instead")
+			}
+
+			tmpFolder, err := createTempDir(tmpDir)
+			if err != nil {
+				return err
+			}
+			defer shred(tmpFolder)
+			target.decrypted = tmpFolder
+
+			if err := DecryptFolder(keys.DecryptKey, target.path, tmpFolder); err != nil {
+				return err
+			}
+			if mode == "write" {
+				if target.original, err = snapshotDecrypted(tmpFolder, true); err != nil {
+					return err
+				}
+			}
+		} else if parameters.fifo {
+			if mode == "write" {
+				return NewSaggyErrorWithMeta("Cannot write back through a FIFO", nil, struct{ Path string }{Path: target.path})
+			}
+
+			tmpFolder, err := createTempDir(tmpDir)
+			if err != nil {
+				return err
+			}
+			defer shred(tmpFolder)
+			target.decrypted = filepath.Join(tmpFolder, filepath.Base(target.path))
+
+			data, err := os.ReadFile(target.path)
+			if err != nil {
+				return NewSaggyError("Failed to read file", err)
+			}
+			plaintext, err := SopsDecrypt(keys.DecryptKey, data, sopsFormatForPath(target.path), target.path)
+			if err != nil {
+				return err
+			}
+			if err := makeFifo(target.decrypted); err != nil {
+				return NewSaggyErrorWithMeta("Failed to create FIFO", err, struct{ Path string }{Path: target.decrypted})
+			}
+			target.delivered = deliverThroughFifo(target.decrypted, plaintext, parameters.fifoTimeout, exited)
+		} else {
+			tmpFile, s_err := createTempFile(tmpDir)
+			if s_err != nil {
+				return NewSaggyError("Failed to create temporary file", s_err)
+			}
+			defer shred(tmpFile)
+			target.decrypted = tmpFile
+
+			if err := DecryptFile(keys.DecryptKey, target.path, tmpFile); err != nil {
+				return err
+			}
+			if mode == "write" {
+				if target.original, err = snapshotDecrypted(tmpFile, false); err != nil {
+					return err
+				}
+			}
+		}
 	}
-	defer os.Remove(tmpFile)
+	// Should anything fail before the command runs, stop waiting on the FIFOs
+	defer func() {
+		select {
+		case <-exited:
+		default:
+			close(exited)
+		}
+	}()
 
-	if err := DecryptFile(keys.DecryptKey, file, tmpFile); err != nil {
+	cmd, err := substituteCommand(parameters.command, targets, parameters.shell)
+	if err != nil {
 		return err
 	}
-	if mode == "write" {
-		defer EncryptFile(keys.EncryptKeys, tmpFile, file)
+
+	// A signal received while decrypting means the command should not be run at all
+	select {
+	case sig := <-interrupted:
+		return NewSilentError(NewSaggyError("Interrupted before running the command", nil), signalExitCode(sig))
+	default:
 	}
 
-	// Substitute {} with the temporary file
-	for i := range command {
-		command[i] = strings.ReplaceAll(command[i], "{}", tmpFile)
+	cmdErr := runCommand(cmd)
+	close(exited)
+
+	// A FIFO that was never read is reported, though the command's own failure takes precedence
+	for _, target := range targets {
+		if target.delivered == nil {
+			continue
+		}
+		if err := <-target.delivered; err != nil {
+			if cmdErr != nil {
+				fmt.Fprintln(os.Stderr, err)
+			} else {
+				cmdErr = err
+			}
+		}
 	}
-	subcommand := strings.Join(command, " ")
 
-	cmd := exec.Command("sh", "-c", subcommand)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
-		exactError := NewCommandError("Failed to run command", "", cmd)
-		return NewSilentError(exactError, cmd.ProcessState.ExitCode())
+	if mode == "write" {
+		if cmdErr != nil {
+			fmt.Fprintln(os.Stderr, "The command failed; changes have not been written back")
+			return cmdErr
+		}
+		for _, target := range targets {
+			result, err := writeBack(keys.EncryptKeys, target)
+			if target.isDir {
+				printWriteBackResult(os.Stderr, result)
+			}
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	return nil
+	return cmdErr
 }
 
-func withFolder(keys *Keys, folder string, command []string, mode string) error {
-	tmpFolder, err := createTempDir()
+// withEnv runs the command with every top level key of the decrypted file set as an environment variable
+func withEnv(keys *Keys, file string, command []string, prefix string) error {
+	branch, format, err := decryptToBranch(keys.DecryptKey, file)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpFolder)
+	if format == "binary" {
+		return NewSaggyError("Cannot export a binary secret as environment variables; it must be yaml, json or dotenv", nil)
+	}
 
-	if err := DecryptFolder(keys.DecryptKey, folder, tmpFolder); err != nil {
-		return err
+	env := []string{}
+	for _, item := range branch {
+		if _, isComment := item.Key.(sops.Comment); isComment {
+			continue
+		}
+		name := prefix + fmt.Sprint(item.Key)
+		if !isValidEnvName(name) {
+			return NewSaggyErrorWithMeta("Invalid environment variable name", nil, struct{ Name string }{Name: name})
+		}
+		value, err := branchValueToString(item.Value, format)
+		if err != nil {
+			return err
+		}
+		env = append(env, name+"="+value)
 	}
-	if mode == "write" {
-		defer EncryptFolder(keys.EncryptKeys, tmpFolder, folder)
+
+	return runWithEnv(env, command)
+}
+
+// substituteCommand builds the command to run, replacing every placeholder with its decrypted file or folder
+//
+// Without a shell the arguments are run directly, so they are never reinterpreted.
+// With a shell the arguments are joined into shell source, with the paths quoted.
+func substituteCommand(command []string, targets []*withDecrypted, shell string) (*exec.Cmd, error) {
+	if len(command) == 0 {
+		return nil, NewSaggyError("No command provided", nil)
+	}
+
+	replacements := []string{}
+	for _, target := range targets {
+		if shell == "" {
+			replacements = append(replacements, target.placeholder, target.decrypted)
+		} else {
+			replacements = append(replacements, target.placeholder, shellQuote(target.decrypted))
+		}
 	}
+	replacer := strings.NewReplacer(replacements...)
 
-	// Substitute {} with the temporary folder
+	argv := make([]string, len(command))
 	for i := range command {
-		command[i] = strings.ReplaceAll(command[i], "{}", tmpFolder)
+		argv[i] = replacer.Replace(command[i])
 	}
-	subcommand := strings.Join(command, " ")
 
-	// Run the command
-	cmd := exec.Command("sh", "-c", subcommand)
+	if shell == "" {
+		return exec.Command(argv[0], argv[1:]...), nil
+	}
+	return exec.Command(shell, "-c", strings.Join(argv, " ")), nil
+}
+
+// runCommand runs the command attached to the terminal, passing its exit code through
+//
+// Interrupts, terminations and hangups are forwarded to the command, and saggy waits for it to exit
+// rather than being killed alongside it.
+func runCommand(cmd *exec.Cmd) error {
+	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
+
+	signals, stop := catchSignals()
+	defer stop()
+
+	if err := cmd.Start(); err != nil {
+		return NewSaggyError("Failed to start command", err)
+	}
+	done := make(chan struct{})
+	go forwardSignals(cmd, signals, done)
+	err := cmd.Wait()
+	close(done)
+
+	if err != nil {
+		if cmd.ProcessState == nil {
+			return NewSaggyError("Failed to run command", err)
+		}
 		exactError := NewCommandError("Failed to run command", "", cmd)
-		return NewSilentError(exactError, cmd.ProcessState.ExitCode())
+		return NewSilentError(exactError, exitCode(cmd))
 	}
 
 	return nil
@@ -0,0 +1,171 @@
+package saggy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// snapshotDecrypted reads every decrypted file, keyed by its path relative to the decrypted location
+// A single file is keyed by the empty string
+func snapshotDecrypted(decrypted string, isDir bool) (map[string][]byte, error) {
+	snapshot := make(map[string][]byte)
+	if !isDir {
+		data, err := os.ReadFile(decrypted)
+		if err != nil {
+			return nil, NewSaggyError("Failed to read decrypted file", err)
+		}
+		snapshot[""] = data
+		return snapshot, nil
+	}
+
+	err := filepath.WalkDir(decrypted, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(decrypted, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		snapshot[relPath] = data
+		return nil
+	})
+	if err != nil {
+		return nil, NewSaggyError("Failed to read decrypted folder", err)
+	}
+	return snapshot, nil
+}
+
+type writeBackResult struct {
+	// The encrypted files created, updated and removed to mirror the decrypted location
+	Added   []string
+	Updated []string
+	Removed []string
+}
+
+// writeBack mirrors whatever changed in the decrypted location back onto the target
+//
+// Files whose content is byte-identical to what was decrypted are left alone, so that
+// an unchanged secret is not re-encrypted with a new data key. For folders, files that
+// were deleted or renamed away have their encrypted counterparts removed; the new encrypted
+// folder is staged and only swapped in once complete, so on any error the target is left as it was.
+func writeBack(keys *EncryptKeys, target *withDecrypted) (*writeBackResult, error) {
+	current, err := snapshotDecrypted(target.decrypted, target.isDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &writeBackResult{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	if !target.isDir {
+		original, existed := target.original[""]
+		if existed && bytes.Equal(original, current[""]) {
+			return result, nil
+		}
+		if err := EncryptFile(keys, target.decrypted, target.path); err != nil {
+			return nil, NewSaggyErrorWithMeta("Failed to write changes back", err, struct{ Path string }{Path: target.path})
+		}
+		if existed {
+			result.Updated = append(result.Updated, target.path)
+		} else {
+			result.Added = append(result.Added, target.path)
+		}
+		return result, nil
+	}
+
+	err = stageFolder(target.path, 0755, func(stage string) error {
+		for _, relPath := range sortedKeys(current) {
+			original, existed := target.original[relPath]
+			if existed && bytes.Equal(original, current[relPath]) {
+				continue
+			}
+
+			from := filepath.Join(target.decrypted, relPath)
+			staged := filepath.Join(stage, getSopsifiedFilename(relPath))
+			to := filepath.Join(target.path, getSopsifiedFilename(relPath))
+			if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+				return NewSaggyError("Failed to create directory", err)
+			}
+
+			// Rules are matched against where the file ends up, not where it is staged
+			fileKeys, err := keys.forPath(to)
+			if err != nil {
+				return err
+			}
+			if err := streamFile(from, staged, 0644, func(r io.Reader, w io.Writer) error {
+				return SopsEncryptStream(fileKeys, r, w, sopsFormatForPath(from), from)
+			}); err != nil {
+				return NewSaggyErrorWithMeta("Failed to write changes back", err, struct{ Path string }{Path: to})
+			}
+			if existed {
+				result.Updated = append(result.Updated, to)
+			} else {
+				result.Added = append(result.Added, to)
+			}
+		}
+
+		for _, relPath := range sortedKeys(target.original) {
+			if _, ok := current[relPath]; ok {
+				continue
+			}
+
+			staged := filepath.Join(stage, getSopsifiedFilename(relPath))
+			if err := os.Remove(staged); err != nil && !os.IsNotExist(err) {
+				return NewSaggyErrorWithMeta("Failed to remove deleted file", err, struct{ Path string }{Path: staged})
+			}
+			removeEmptyParents(filepath.Dir(staged), stage)
+			result.Removed = append(result.Removed, filepath.Join(target.path, getSopsifiedFilename(relPath)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// removeEmptyParents removes the directory and its parents while they are empty, stopping at root
+func removeEmptyParents(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printWriteBackResult writes a summary of the encrypted files that changed
+func printWriteBackResult(w io.Writer, result *writeBackResult) {
+	if result == nil {
+		return
+	}
+	for _, path := range result.Added {
+		fmt.Fprintf(w, "added %s\n", path)
+	}
+	for _, path := range result.Updated {
+		fmt.Fprintf(w, "updated %s\n", path)
+	}
+	for _, path := range result.Removed {
+		fmt.Fprintf(w, "removed %s\n", path)
+	}
+}
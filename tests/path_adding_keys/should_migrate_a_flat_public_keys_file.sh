@@ -0,0 +1,45 @@
+#!/bin/bash
+
+## Setup
+
+SECRETS_DIR="./secrets"
+PUBLIC_KEYFILE="$SECRETS_DIR/public-age-keys.json"
+PLAINTEXT_FILE="./plaintext"
+
+mkdir -p "$SECRETS_DIR"
+echo "test content" > "$PLAINTEXT_FILE"
+
+# A key registered in the original flat layout
+$SAGGY keygen - > "$SECRETS_DIR/old.key"
+OLD_PUBLIC_KEY=$(sed -n "s/^# public key: //p" "$SECRETS_DIR/old.key")
+echo "{\"oldkey\":\"$OLD_PUBLIC_KEY\"}" > "$PUBLIC_KEYFILE"
+
+## Should still read the flat layout
+
+$SAGGY encrypt "$PLAINTEXT_FILE" ./flat.sops
+SAGGY_KEY_FILE="$SECRETS_DIR/old.key" $SAGGY decrypt ./flat.sops ./flat.decrypted
+if ! diff -q ./flat.decrypted "$PLAINTEXT_FILE" >/dev/null; then echo "Should encrypt for the keys in the flat layout."; exit 1; fi
+
+## Should write the versioned layout with metadata when adding a key
+
+SAGGY_KEYNAME=newkey $SAGGY keygen --owner "Alice" --comment "build server" --type ci --group ops --expires 2030-01-01
+if ! grep -q '"version": 2' "$PUBLIC_KEYFILE"; then echo "Should write version 2."; exit 1; fi
+for FIELD in '"owner": "Alice"' '"comment": "build server"' '"type": "ci"' '"ops"' '"expires": "2030-01-01T00:00:00Z"' '"created": '; do
+    if ! grep -q "$FIELD" "$PUBLIC_KEYFILE"; then echo "Should record $FIELD."; exit 1; fi
+done
+if ! grep -q "$OLD_PUBLIC_KEY" "$PUBLIC_KEYFILE"; then echo "Should keep the migrated key."; exit 1; fi
+
+if SAGGY_KEYNAME=badkey SAGGY_KEY_FILE="$SECRETS_DIR/bad.key" $SAGGY keygen --expires soon 2>/dev/null; then echo "Should reject an invalid expiry date."; exit 1; fi
+
+## Should encrypt for every key in the versioned layout
+
+$SAGGY encrypt "$PLAINTEXT_FILE" ./versioned.sops
+SAGGY_KEY_FILE="$SECRETS_DIR/old.key" $SAGGY decrypt ./versioned.sops ./old.decrypted
+$SAGGY decrypt ./versioned.sops ./new.decrypted
+if ! diff -q ./old.decrypted "$PLAINTEXT_FILE" >/dev/null; then echo "Should encrypt for the migrated key."; exit 1; fi
+if ! diff -q ./new.decrypted "$PLAINTEXT_FILE" >/dev/null; then echo "Should encrypt for the new key."; exit 1; fi
+
+## Should refuse a version it does not know
+
+sed -i 's/"version": 2/"version": 99/' "$PUBLIC_KEYFILE"
+if $SAGGY encrypt "$PLAINTEXT_FILE" ./future.sops 2>/dev/null; then echo "Should refuse an unknown version."; exit 1; fi
@@ -0,0 +1,29 @@
+#!/bin/bash
+
+## Setup
+
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+
+mkdir -p ./secrets ./private
+
+## Should keep every key when several are generated at once
+
+PIDS=()
+for i in 1 2 3 4 5 6 7 8; do
+  SAGGY_KEYNAME="key$i" SAGGY_KEY_FILE="./private/key$i" $SAGGY keygen &
+  PIDS+=($!)
+done
+for pid in "${PIDS[@]}"; do wait "$pid"; done
+
+if [ -e "$PUBLIC_KEYFILE.lock" ]; then echo "Should remove the lock file once done."; exit 1; fi
+
+for i in 1 2 3 4 5 6 7 8; do
+  if ! grep -q "\"key$i\"" "$PUBLIC_KEYFILE"; then echo "Should include key$i in the public keyfile."; exit 1; fi
+done
+
+## Should preserve stricter permissions on the public keys file
+
+chmod 600 "$PUBLIC_KEYFILE"
+SAGGY_KEYNAME=key9 SAGGY_KEY_FILE="./private/key9" $SAGGY keygen
+if [ "$(stat -c %a "$PUBLIC_KEYFILE")" != "600" ]; then echo "Should keep the stricter permissions."; exit 1; fi
+if ! grep -q "\"key9\"" "$PUBLIC_KEYFILE"; then echo "Should include key9 in the public keyfile."; exit 1; fi
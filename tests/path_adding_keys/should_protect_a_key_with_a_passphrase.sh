@@ -0,0 +1,31 @@
+#!/bin/bash
+
+## Setup
+
+PRIVATE_KEYFILE="./secrets/age.key"
+PASSPHRASE_FILE="./passphrase"
+ENCRYPTED_FILE="./testfile.sops"
+PLAINTEXT_FILE="./testfile.plaintext"
+DECRYPTED_FILE="./testfile.decrypted"
+STDERR_FILE="./.stderr"
+
+echo "test content" > "$PLAINTEXT_FILE"
+echo "correct horse battery staple" > "$PASSPHRASE_FILE"
+
+## Should write a passphrase protected key
+
+SAGGY_PASSPHRASE_FILE="$PASSPHRASE_FILE" $SAGGY keygen --passphrase
+if ! grep -q "BEGIN AGE ENCRYPTED FILE" "$PRIVATE_KEYFILE"; then echo "Should armor the protected key."; exit 1; fi
+if grep -q "AGE-SECRET-KEY-" "$PRIVATE_KEYFILE"; then echo "Should not store the key in plain text."; exit 1; fi
+
+## Should decrypt with the passphrase
+
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+SAGGY_PASSPHRASE="correct horse battery staple" $SAGGY decrypt "$ENCRYPTED_FILE" "$DECRYPTED_FILE"
+if ! diff "$PLAINTEXT_FILE" "$DECRYPTED_FILE"; then echo "Should decrypt with the passphrase."; exit 1; fi
+
+## Should fail clearly with the wrong passphrase
+
+if SAGGY_PASSPHRASE="wrong" $SAGGY decrypt "$ENCRYPTED_FILE" "$DECRYPTED_FILE" 2> "$STDERR_FILE"; then echo "Should fail with the wrong passphrase."; exit 1; fi
+if ! grep -q "Incorrect passphrase" "$STDERR_FILE"; then echo "Should say the passphrase is incorrect."; exit 1; fi
+
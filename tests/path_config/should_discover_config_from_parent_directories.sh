@@ -0,0 +1,37 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./project/deep/sub/dir/plaintext"
+VAULT_DIR="./project/vault"
+
+mkdir -p ./project/deep/sub/dir
+echo "test content" > "$PLAINTEXT_FILE"
+
+cat > ./project/.saggy.yaml <<'YAML'
+secretsDir: vault
+keyName: "configured-{hostname}"
+YAML
+
+## Should resolve the secrets directory against the config file from a subdirectory
+
+(cd ./project/deep/sub/dir && $SAGGY keygen)
+if [ ! -f "$VAULT_DIR/age.key" ]; then echo "Should create the key in the configured secrets directory."; exit 1; fi
+if [ -e ./project/deep/sub/dir/secrets ]; then echo "Should not create secrets relative to the current directory."; exit 1; fi
+if ! grep -q '"configured-' "$VAULT_DIR/public-age-keys.json"; then echo "Should name the key by the configured scheme."; exit 1; fi
+
+(cd ./project/deep && $SAGGY encrypt sub/dir/plaintext)
+(cd ./project/deep/sub && $SAGGY decrypt dir/plaintext.sops dir/decrypted)
+if ! diff -q ./project/deep/sub/dir/decrypted "$PLAINTEXT_FILE" >/dev/null; then echo "Should decrypt with the configured key."; exit 1; fi
+
+## Should let the environment override the config file
+
+mkdir -p ./elsewhere
+(cd ./project/deep && SAGGY_SECRETS_DIR=../../elsewhere SAGGY_KEYNAME=override $SAGGY keygen)
+if [ ! -f ./elsewhere/age.key ]; then echo "Should use SAGGY_SECRETS_DIR over the config file."; exit 1; fi
+if ! grep -q '"override"' ./elsewhere/public-age-keys.json; then echo "Should use SAGGY_KEYNAME over the config file."; exit 1; fi
+
+## Should reject settings it does not recognise
+
+echo "secretDir: typo" > ./project/.saggy.yaml
+if (cd ./project/deep && $SAGGY decrypt sub/dir/plaintext.sops - >/dev/null 2>&1); then echo "Should reject an unknown setting."; exit 1; fi
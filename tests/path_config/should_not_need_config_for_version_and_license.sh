@@ -0,0 +1,14 @@
+#!/bin/bash
+
+## Setup
+
+echo "notASetting: true" > ./.saggy.yaml
+
+## Should refuse a config file it does not understand
+
+if $SAGGY keygen 2>/dev/null; then echo "Should refuse the unknown setting."; exit 1; fi
+
+## Should still print the version and license
+
+if ! $SAGGY version >/dev/null; then echo "Should print the version without reading the config file."; exit 1; fi
+if ! $SAGGY license >/dev/null; then echo "Should print the license without reading the config file."; exit 1; fi
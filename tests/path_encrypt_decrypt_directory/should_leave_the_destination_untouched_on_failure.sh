@@ -0,0 +1,32 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_DIR="./testdir.sops"
+DECRYPTED_DIR="./decrypted"
+PLAINTEXT_DIR="./plaintext"
+
+mkdir -p "$PLAINTEXT_DIR"
+echo "test content 1" > "$PLAINTEXT_DIR/file1.txt"
+echo "test content 2" > "$PLAINTEXT_DIR/file2.txt"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+$SAGGY decrypt "$ENCRYPTED_DIR" "$DECRYPTED_DIR"
+echo "stale content" > "$DECRYPTED_DIR/file1.txt"
+
+# Corrupt one of the encrypted files so decryption fails partway through
+echo "not encrypted" > "$ENCRYPTED_DIR/file2.sops.txt"
+
+## Should fail to decrypt
+
+if $SAGGY decrypt "$ENCRYPTED_DIR" "$DECRYPTED_DIR"; then echo "Should fail to decrypt a corrupted file."; exit 1; fi
+
+## Should leave the destination as it was
+
+if [ "$(cat "$DECRYPTED_DIR/file1.txt")" != "stale content" ]; then echo "Should not update any file on failure."; exit 1; fi
+if [ "$(cat "$DECRYPTED_DIR/file2.txt")" != "test content 2" ]; then echo "Should keep the existing files on failure."; exit 1; fi
+
+## Should clean up the staged folder
+
+if [ -n "$(find . -maxdepth 1 -name '.decrypted*.tmp')" ]; then echo "Should remove the staged folder."; exit 1; fi
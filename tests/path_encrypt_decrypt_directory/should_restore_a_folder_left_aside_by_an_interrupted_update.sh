@@ -0,0 +1,32 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_DIR="./testdir.sops"
+PLAINTEXT_DIR="./plaintext"
+
+mkdir -p "$PLAINTEXT_DIR"
+echo "test content 1" > "$PLAINTEXT_DIR/file1.txt"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+echo "kept content" > "$ENCRYPTED_DIR/kept.txt"
+
+# An update interrupted after moving the original aside, but before moving its replacement into place
+mv "$ENCRYPTED_DIR" "./.testdir.sops.orig"
+
+## Should restore the original before updating it
+
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR" 2> stderr.txt
+
+if ! grep -q "Restoring" stderr.txt; then echo "Should say that the original was restored."; exit 1; fi
+if [ "$(cat "$ENCRYPTED_DIR/kept.txt")" != "kept content" ]; then echo "Should keep the files of the original."; exit 1; fi
+if [ -e "./.testdir.sops.orig" ]; then echo "Should not leave the original aside."; exit 1; fi
+
+## Should remove an original left aside after its replacement was moved into place
+
+mkdir "./.testdir.sops.orig"
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+
+if [ -e "./.testdir.sops.orig" ]; then echo "Should remove the leftover original."; exit 1; fi
+if [ "$(cat "$ENCRYPTED_DIR/kept.txt")" != "kept content" ]; then echo "Should keep the files of the folder in place."; exit 1; fi
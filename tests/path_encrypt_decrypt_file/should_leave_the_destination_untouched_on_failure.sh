@@ -0,0 +1,23 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_FILE="./testfile.sops"
+DECRYPTED_FILE="./testfile.decrypted"
+
+echo "not encrypted" > "$ENCRYPTED_FILE"
+echo "existing content" > "$DECRYPTED_FILE"
+
+$SAGGY keygen
+
+## Should fail to decrypt
+
+if $SAGGY decrypt "$ENCRYPTED_FILE" "$DECRYPTED_FILE"; then echo "Should fail to decrypt a corrupted file."; exit 1; fi
+
+## Should leave the destination as it was
+
+if [ "$(cat "$DECRYPTED_FILE")" != "existing content" ]; then echo "Should not replace the destination on failure."; exit 1; fi
+
+## Should clean up the partially written file
+
+if [ -n "$(find . -maxdepth 1 -name '.testfile.decrypted*.tmp')" ]; then echo "Should remove the temporary file."; exit 1; fi
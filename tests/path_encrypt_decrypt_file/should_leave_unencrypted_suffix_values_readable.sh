@@ -0,0 +1,22 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./testfile.yaml"
+ENCRYPTED_FILE="./testfile.sops.yaml"
+DECRYPTED_FILE="./testfile.decrypted.yaml"
+
+printf 'password: hunter2\nnote_unencrypted: visible to all\n' > "$PLAINTEXT_FILE"
+$SAGGY keygen
+
+## Should leave values under keys ending _unencrypted readable, as the sops binary does
+
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+if ! grep -q "note_unencrypted: visible to all" "$ENCRYPTED_FILE"; then echo "Should not encrypt the _unencrypted value."; exit 1; fi
+if grep -q "hunter2" "$ENCRYPTED_FILE"; then echo "Should encrypt every other value."; exit 1; fi
+if ! grep -q "unencrypted_suffix: _unencrypted" "$ENCRYPTED_FILE"; then echo "Should record the suffix in the metadata."; exit 1; fi
+
+## Should decrypt back to the original
+
+$SAGGY decrypt "$ENCRYPTED_FILE" "$DECRYPTED_FILE"
+if ! diff "$PLAINTEXT_FILE" "$DECRYPTED_FILE"; then echo "Should decrypt to the original."; exit 1; fi
@@ -0,0 +1,18 @@
+#!/bin/bash
+
+## Setup
+
+echo "key: [unterminated" > ./bad.yaml
+echo "not encrypted" > ./corrupted.txt
+
+$SAGGY keygen
+
+## Should not leave an encrypted file behind
+
+if $SAGGY encrypt ./bad.yaml 2>/dev/null; then echo "Should fail to encrypt invalid yaml."; exit 1; fi
+if [ -e ./bad.sops.yaml ]; then echo "Should not create the destination when encryption fails."; exit 1; fi
+
+## Should not leave a decrypted file behind
+
+if $SAGGY decrypt ./corrupted.txt ./out.txt 2>/dev/null; then echo "Should fail to decrypt a corrupted file."; exit 1; fi
+if [ -e ./out.txt ]; then echo "Should not create the destination when decryption fails."; exit 1; fi
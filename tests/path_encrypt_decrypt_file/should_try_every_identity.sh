@@ -0,0 +1,65 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./plaintext"
+SECRETS_DIR="./secrets"
+PERSONAL_KEYFILE="$SECRETS_DIR/personal.key"
+CI_KEYFILE="$SECRETS_DIR/ci.key"
+PERSONAL_PUBLIC_KEYFILE="$SECRETS_DIR/personal-public-keys.json"
+CI_PUBLIC_KEYFILE="$SECRETS_DIR/ci-public-keys.json"
+
+mkdir -p "$SECRETS_DIR"
+
+echo "test content" > "$PLAINTEXT_FILE"
+
+# A personal key, and a shared CI key, each with secrets only it can open
+SAGGY_KEYNAME=personal SAGGY_KEY_FILE="$PERSONAL_KEYFILE" SAGGY_PUBLIC_KEYS_FILE="$PERSONAL_PUBLIC_KEYFILE" $SAGGY keygen
+SAGGY_KEYNAME=ci SAGGY_KEY_FILE="$CI_KEYFILE" SAGGY_PUBLIC_KEYS_FILE="$CI_PUBLIC_KEYFILE" $SAGGY keygen
+
+SAGGY_PUBLIC_KEYS_FILE="$PERSONAL_PUBLIC_KEYFILE" $SAGGY encrypt "$PLAINTEXT_FILE" ./personal.sops
+SAGGY_PUBLIC_KEYS_FILE="$CI_PUBLIC_KEYFILE" $SAGGY encrypt "$PLAINTEXT_FILE" ./ci.sops
+
+## Should not decrypt with a key that is not a recipient
+
+if SAGGY_KEY_FILE="$PERSONAL_KEYFILE" $SAGGY decrypt ./ci.sops ./decrypted 2>/dev/null; then echo "Should not decrypt without the CI key."; exit 1; fi
+
+## Should try every key file in SAGGY_KEY_FILE
+
+export SAGGY_KEY_FILE="$PERSONAL_KEYFILE:$CI_KEYFILE"
+$SAGGY decrypt ./personal.sops ./decrypted_personal
+$SAGGY decrypt ./ci.sops ./decrypted_ci
+if ! diff -q ./decrypted_personal "$PLAINTEXT_FILE" >/dev/null; then echo "Should decrypt with the first key file."; exit 1; fi
+if ! diff -q ./decrypted_ci "$PLAINTEXT_FILE" >/dev/null; then echo "Should decrypt with the second key file."; exit 1; fi
+rm ./decrypted_personal ./decrypted_ci
+
+## Should try every key in a single key file
+
+cat "$PERSONAL_KEYFILE" "$CI_KEYFILE" > "$SECRETS_DIR/both.key"
+SAGGY_KEY_FILE="$SECRETS_DIR/both.key" $SAGGY decrypt ./ci.sops ./decrypted_ci
+if ! diff -q ./decrypted_ci "$PLAINTEXT_FILE" >/dev/null; then echo "Should decrypt with the second key in the file."; exit 1; fi
+rm ./decrypted_ci
+
+## Should try each --identity after SAGGY_KEY_FILE
+
+export SAGGY_KEY_FILE="$PERSONAL_KEYFILE"
+$SAGGY decrypt ./ci.sops ./decrypted_ci --identity "$CI_KEYFILE"
+if ! diff -q ./decrypted_ci "$PLAINTEXT_FILE" >/dev/null; then echo "Should decrypt with the identity."; exit 1; fi
+
+OUTPUT=$($SAGGY with ./ci.sops --identity "$CI_KEYFILE" -- cat {})
+if [ "$OUTPUT" != "test content" ]; then echo "Should decrypt with the identity when running a command."; exit 1; fi
+
+## Should use an identity alone when the key file does not exist
+
+OUTPUT=$(SAGGY_KEY_FILE="$SECRETS_DIR/missing.key" $SAGGY decrypt ./ci.sops - --identity="$CI_KEYFILE")
+if [ "$OUTPUT" != "test content" ]; then echo "Should decrypt with only the identity."; exit 1; fi
+
+## Should skip key files in SAGGY_KEY_FILE which do not exist, saying so
+
+OUTPUT=$(SAGGY_KEY_FILE="$PERSONAL_KEYFILE:$SECRETS_DIR/missing.key:$CI_KEYFILE" $SAGGY decrypt ./ci.sops - 2> stderr.txt)
+if [ "$OUTPUT" != "test content" ]; then echo "Should decrypt with the key files that exist."; exit 1; fi
+if ! grep -q "missing.key" stderr.txt; then echo "Should warn about the missing key file."; exit 1; fi
+
+## Should fail when none of the key files exist
+
+if SAGGY_KEY_FILE="$SECRETS_DIR/missing.key:$SECRETS_DIR/also-missing.key" $SAGGY decrypt ./ci.sops - 2>/dev/null; then echo "Should fail without any key file."; exit 1; fi
@@ -0,0 +1,56 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./token.plaintext"
+ENCRYPTED_FILE="./token.sops"
+PLAINTEXT_YAML="./database.yaml"
+ENCRYPTED_YAML="./database.sops.yaml"
+
+printf "s3cr3t" > "$PLAINTEXT_FILE"
+cat > "$PLAINTEXT_YAML" <<YAML
+username: admin
+password: hunter2
+port: 5432
+YAML
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+$SAGGY encrypt "$PLAINTEXT_YAML" "$ENCRYPTED_YAML"
+
+## Should export the whole secret
+
+$SAGGY env TOKEN="$ENCRYPTED_FILE" -- sh -c 'printf "%s" "$TOKEN"' > ./token_output
+if ! diff "$PLAINTEXT_FILE" ./token_output; then echo "Should export the decrypted file."; exit 1; fi
+
+## Should export selected keys
+
+$SAGGY env DB_PASSWORD="$ENCRYPTED_YAML#password" DB_PORT="$ENCRYPTED_YAML#port" -- sh -c 'echo "$DB_PASSWORD:$DB_PORT"' > ./yaml_output
+if [ "$(cat ./yaml_output)" != "hunter2:5432" ]; then echo "Should export the selected keys."; exit 1; fi
+
+## Should not write the plaintext to disk
+
+if grep -rq "hunter2" "$TMPDIR"; then echo "Should not write the plaintext to the temporary directory."; exit 1; fi
+
+## Should be transparent to the exit code
+
+set +e
+$SAGGY env TOKEN="$ENCRYPTED_FILE" -- sh -c 'exit 7'
+EXIT_CODE=$?
+set -e
+if [ "$EXIT_CODE" -ne 7 ]; then echo "Should pass the exit code through."; exit 1; fi
+
+## Should reject missing keys and invalid names
+
+if $SAGGY env DB_USER="$ENCRYPTED_YAML#missing" -- true; then echo "Should fail for a missing key."; exit 1; fi
+if $SAGGY env 1INVALID="$ENCRYPTED_FILE" -- true; then echo "Should fail for an invalid name."; exit 1; fi
+
+## Should keep a # in the path when it does not select a key
+
+mkdir -p "./team#1"
+$SAGGY encrypt "$PLAINTEXT_FILE" "./team#1/token.sops"
+$SAGGY encrypt "$PLAINTEXT_FILE" "./token#2.sops"
+$SAGGY env TOKEN="./team#1/token.sops" -- sh -c 'printf "%s" "$TOKEN"' > ./dir_hash_output
+if ! diff "$PLAINTEXT_FILE" ./dir_hash_output; then echo "Should read a secret in a folder with # in its name."; exit 1; fi
+$SAGGY env TOKEN="./token#2.sops" -- sh -c 'printf "%s" "$TOKEN"' > ./file_hash_output
+if ! diff "$PLAINTEXT_FILE" ./file_hash_output; then echo "Should read a secret with # in its name."; exit 1; fi
@@ -0,0 +1,58 @@
+#!/bin/bash
+
+## Setup
+
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+PLAINTEXT_FILE="./plaintext"
+
+echo "test content" > "$PLAINTEXT_FILE"
+SAGGY_KEYNAME=me $SAGGY keygen
+
+# Someone else's key, generated on their machine
+$SAGGY keygen - > ./colleague.key
+COLLEAGUE_PUBLIC_KEY=$(sed -n "s/^# public key: //p" ./colleague.key)
+ssh-keygen -q -t ed25519 -N "" -C "robot@ci" -f ./robot
+
+## Should add age and SSH public keys with what is known about them
+
+$SAGGY keys add colleague "$COLLEAGUE_PUBLIC_KEY" --owner Bob --type user
+$SAGGY keys add robot "$(cat ./robot.pub)" --type ci --expires 2000-01-01
+
+$SAGGY encrypt "$PLAINTEXT_FILE" 2> stderr.txt
+if ! grep -q "robot, which expired" stderr.txt; then echo "Should warn when encrypting for an expired key."; exit 1; fi
+if grep -q "colleague, which expired" stderr.txt; then echo "Should not warn about a key that has not expired."; exit 1; fi
+SAGGY_KEY_FILE=./colleague.key $SAGGY decrypt "$PLAINTEXT_FILE.sops" ./decrypted
+if ! diff -q ./decrypted "$PLAINTEXT_FILE" >/dev/null; then echo "Should encrypt for the added key."; exit 1; fi
+
+## Should refuse invalid keys, duplicate names and duplicate keys
+
+if $SAGGY keys add broken "age1notakey" 2>/dev/null; then echo "Should refuse an invalid key."; exit 1; fi
+if $SAGGY keys add colleague "$(cat ./robot.pub)" 2>/dev/null; then echo "Should refuse a duplicate name."; exit 1; fi
+if $SAGGY keys add colleague-again "$COLLEAGUE_PUBLIC_KEY" 2>/dev/null; then echo "Should refuse a duplicate key."; exit 1; fi
+if grep -q "broken\|colleague-again" "$PUBLIC_KEYFILE"; then echo "Should not write refused keys."; exit 1; fi
+
+## Should list and show the keys
+
+OUTPUT=$($SAGGY keys list)
+for NAME in me colleague robot; do
+    if ! echo "$OUTPUT" | grep -q "^$NAME "; then echo "Should list $NAME."; exit 1; fi
+done
+if ! echo "$OUTPUT" | grep "^robot " | grep -q "(expired)"; then echo "Should mark the expired key."; exit 1; fi
+
+OUTPUT=$($SAGGY keys show colleague)
+if ! echo "$OUTPUT" | grep -q "owner: Bob"; then echo "Should show the owner."; exit 1; fi
+if ! echo "$OUTPUT" | grep -q "public key: $COLLEAGUE_PUBLIC_KEY"; then echo "Should show the public key."; exit 1; fi
+if $SAGGY keys show nobody 2>/dev/null; then echo "Should refuse to show an unknown key."; exit 1; fi
+
+## Should remove keys by name
+
+$SAGGY keys remove robot
+if grep -q "robot" "$PUBLIC_KEYFILE"; then echo "Should remove the key."; exit 1; fi
+if $SAGGY keys remove robot 2>/dev/null; then echo "Should refuse to remove an unknown key."; exit 1; fi
+
+## Should refuse a public keys file with the same key under two names
+
+echo "{\"a\":\"$COLLEAGUE_PUBLIC_KEY\",\"b\":\"$COLLEAGUE_PUBLIC_KEY\"}" > "$PUBLIC_KEYFILE"
+if $SAGGY keys list 2>/dev/null; then echo "Should refuse duplicate keys."; exit 1; fi
+echo "{\"a\":\"$COLLEAGUE_PUBLIC_KEY\",\"a\":\"$COLLEAGUE_PUBLIC_KEY\"}" > "$PUBLIC_KEYFILE"
+if $SAGGY keys list 2>/dev/null; then echo "Should refuse duplicate names."; exit 1; fi
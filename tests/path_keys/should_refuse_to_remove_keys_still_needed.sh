@@ -0,0 +1,30 @@
+#!/bin/bash
+
+## Setup
+
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+
+mkdir -p ./prod
+echo "test content" > ./prod/plaintext
+SAGGY_KEYNAME=alice SAGGY_KEY_FILE=./alice.key $SAGGY keygen
+SAGGY_KEYNAME=bob $SAGGY keygen
+
+cat > ./.saggy.yaml <<YAML
+rules:
+  - path: prod/**
+    recipients: [alice]
+YAML
+$SAGGY encrypt ./prod/plaintext
+
+## Should refuse to remove a key that a rule names
+
+if $SAGGY keys remove alice 2>/dev/null; then echo "Should refuse to remove a key named by a rule."; exit 1; fi
+if $SAGGY revoke alice ./prod 2>/dev/null; then echo "Should refuse to revoke a key named by a rule."; exit 1; fi
+if ! grep -q '"alice"' "$PUBLIC_KEYFILE"; then echo "Should keep the key named by a rule."; exit 1; fi
+
+## Should refuse to remove the only key
+
+rm ./.saggy.yaml
+$SAGGY keys remove alice
+if $SAGGY keys remove bob 2>/dev/null; then echo "Should refuse to remove the only key."; exit 1; fi
+if ! grep -q '"bob"' "$PUBLIC_KEYFILE"; then echo "Should keep the only key."; exit 1; fi
@@ -0,0 +1,72 @@
+#!/bin/bash
+
+## Setup
+
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+PLAINTEXT_FILE="./plaintext"
+
+echo "test content" > "$PLAINTEXT_FILE"
+SAGGY_KEYNAME=alice SAGGY_KEY_FILE=./alice.key $SAGGY keygen
+SAGGY_KEYNAME=bob SAGGY_KEY_FILE=./bob.key $SAGGY keygen
+
+## Should encrypt for every key while nothing is endorsed
+
+SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE"
+if [ ! -f "$PLAINTEXT_FILE.sops" ]; then echo "Should encrypt while the file is unsigned."; exit 1; fi
+rm "$PLAINTEXT_FILE.sops"
+
+## Should encrypt for keys endorsed by this host and by those it trusts
+
+SAGGY_KEY_FILE=./alice.key $SAGGY keys endorse bob
+SAGGY_KEY_FILE=./bob.key $SAGGY keys endorse alice
+if ! $SAGGY keys show bob | grep -q "endorsed by: alice"; then echo "Should show the endorsement."; exit 1; fi
+
+SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE"
+SAGGY_KEY_FILE=./bob.key $SAGGY decrypt "$PLAINTEXT_FILE.sops" ./decrypted
+if ! diff -q ./decrypted "$PLAINTEXT_FILE" >/dev/null; then echo "Should encrypt for the endorsed key."; exit 1; fi
+rm "$PLAINTEXT_FILE.sops"
+
+## Should refuse to encrypt for a key nobody has endorsed
+
+SAGGY_KEYNAME=mallory SAGGY_KEY_FILE=./mallory.key $SAGGY keygen
+if SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE" 2>/dev/null; then echo "Should refuse the unendorsed key."; exit 1; fi
+if [ -f "$PLAINTEXT_FILE.sops" ]; then echo "Should not write the refused file."; exit 1; fi
+
+## Should trust a key endorsed by a trusted member
+
+SAGGY_KEY_FILE=./alice.key $SAGGY keys endorse mallory
+SAGGY_KEY_FILE=./bob.key $SAGGY encrypt "$PLAINTEXT_FILE"
+
+## Should record nothing when only decrypting
+
+OUTPUT=$(XDG_CONFIG_HOME="$PWD/fresh-config" SAGGY_KEY_FILE=./mallory.key $SAGGY with "$PLAINTEXT_FILE.sops" -- cat {})
+if [ "$OUTPUT" != "test content" ]; then echo "Should decrypt with the endorsed key."; exit 1; fi
+if [ -e ./fresh-config ] || [ -e ./mallory.key.endorsements ]; then echo "Should not record anything when only decrypting."; exit 1; fi
+
+## Should only warn when what is checked cannot be recorded
+
+touch ./not-a-directory
+XDG_CONFIG_HOME="$PWD/not-a-directory" SAGGY_KEY_FILE=./bob.key $SAGGY encrypt "$PLAINTEXT_FILE" ./unrecorded.sops 2> stderr.txt
+if [ ! -f ./unrecorded.sops ]; then echo "Should encrypt even though nothing could be recorded."; exit 1; fi
+if ! grep -q "failed to record" stderr.txt; then echo "Should warn that nothing could be recorded."; exit 1; fi
+rm "$PLAINTEXT_FILE.sops" ./unrecorded.sops
+
+## Should refuse a key whose entry changed after it was endorsed
+
+sed -i 's/"mallory": {/"mallory": {\n      "groups": ["ops"],/' "$PUBLIC_KEYFILE"
+if SAGGY_KEY_FILE=./bob.key $SAGGY encrypt "$PLAINTEXT_FILE" 2>/dev/null; then echo "Should refuse the altered entry."; exit 1; fi
+
+## Should refuse endorsements a key makes for itself
+
+if SAGGY_KEY_FILE=./mallory.key $SAGGY keys endorse mallory 2>/dev/null; then echo "Should refuse a self endorsement."; exit 1; fi
+
+## Should still refuse unendorsed keys once every endorsement is stripped from the file
+
+if [ -e ./alice.key.endorsements ]; then echo "Should not record anything next to the key."; exit 1; fi
+if [ -z "$(ls -A "$XDG_CONFIG_HOME/saggy/endorsements")" ]; then echo "Should record in the config directory that endorsements are checked."; exit 1; fi
+ALICE_PUBLIC_KEY=$(sed -n "s/^# public key: //p" ./alice.key)
+BOB_PUBLIC_KEY=$(sed -n "s/^# public key: //p" ./bob.key)
+echo "{\"alice\": \"$ALICE_PUBLIC_KEY\", \"bob\": \"$BOB_PUBLIC_KEY\"}" > "$PUBLIC_KEYFILE"
+SAGGY_KEYNAME=eve SAGGY_KEY_FILE=./eve.key $SAGGY keygen
+if SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE" 2>/dev/null; then echo "Should refuse the key added after stripping the endorsements."; exit 1; fi
+if [ -f "$PLAINTEXT_FILE.sops" ]; then echo "Should not write the refused file."; exit 1; fi
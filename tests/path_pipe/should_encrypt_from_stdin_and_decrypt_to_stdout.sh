@@ -0,0 +1,30 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_FILE="./testfile.sops.yaml"
+PLAINTEXT_FILE="./testfile.plaintext"
+DECRYPTED_FILE="./testfile.decrypted"
+
+printf 'password: hunter2\n' > "$PLAINTEXT_FILE"
+
+$SAGGY keygen
+
+## Should encrypt from stdin into a file
+
+$SAGGY encrypt - "$ENCRYPTED_FILE" < "$PLAINTEXT_FILE"
+if ! grep -q "ENC\[" "$ENCRYPTED_FILE"; then echo "Should encrypt each value as yaml."; exit 1; fi
+
+## Should decrypt a file to stdout
+
+$SAGGY decrypt "$ENCRYPTED_FILE" - > "$DECRYPTED_FILE"
+if ! diff "$PLAINTEXT_FILE" "$DECRYPTED_FILE"; then echo "Should decrypt to stdout."; exit 1; fi
+
+## Should pipe all the way through with an explicit type
+
+$SAGGY encrypt - --input-type yaml < "$PLAINTEXT_FILE" | $SAGGY decrypt - --output-type yaml > "$DECRYPTED_FILE"
+if ! diff "$PLAINTEXT_FILE" "$DECRYPTED_FILE"; then echo "Should decrypt what was piped in."; exit 1; fi
+
+## Should refuse mismatched types
+
+if $SAGGY encrypt - --input-type yaml --output-type json < "$PLAINTEXT_FILE"; then echo "Should refuse to convert formats."; exit 1; fi
@@ -0,0 +1,46 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./plaintext"
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+
+echo "test content" > "$PLAINTEXT_FILE"
+SAGGY_KEYNAME=alice SAGGY_KEY_FILE=./alice.key $SAGGY keygen
+SAGGY_KEYNAME=bob SAGGY_KEY_FILE=./bob.key $SAGGY keygen
+SAGGY_KEYNAME=carol SAGGY_KEY_FILE=./carol.key $SAGGY keygen
+SAGGY_KEY_FILE=./alice.key $SAGGY keys endorse bob
+SAGGY_KEY_FILE=./alice.key $SAGGY keys endorse carol
+SAGGY_KEY_FILE=./bob.key $SAGGY keys endorse alice
+
+SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE" ./secret.sops
+cp "$PUBLIC_KEYFILE" ./before-revoke.json
+
+## Should record the revoked key in the public keys file
+
+SAGGY_KEY_FILE=./alice.key $SAGGY revoke carol ./secret.sops
+if ! grep -A3 '"revoked"' "$PUBLIC_KEYFILE" | grep -q "$(sed -n "s/^# public key: //p" ./carol.key)"; then echo "Should record the revoked key."; exit 1; fi
+
+## Should refuse carol's old entry, endorsements and all, restored alongside the revocation
+
+# Carol's endorsed entry from before the revoke, with the revocation kept
+{ head -n -1 ./before-revoke.json | sed '$ s/$/,/'; sed -n '/"revoked"/,$p' "$PUBLIC_KEYFILE"; } > ./restored.json
+cp ./restored.json "$PUBLIC_KEYFILE"
+if ! grep -q '"carol"' "$PUBLIC_KEYFILE"; then echo "Should have restored the old entry."; exit 1; fi
+
+# Bob has never seen the revocation recorded, so only the public keys file refuses it
+if XDG_CONFIG_HOME="$PWD/bob-config" SAGGY_KEY_FILE=./bob.key $SAGGY encrypt "$PLAINTEXT_FILE" ./restored.sops 2> stderr.txt; then echo "Should refuse to encrypt for the restored key."; exit 1; fi
+if ! grep -q "revoked" stderr.txt; then echo "Should say that the key was revoked."; exit 1; fi
+if [ -f ./restored.sops ]; then echo "Should not write the refused file."; exit 1; fi
+
+## Should refuse carol's old entry when the whole public keys file from before the revoke is restored
+
+cp ./before-revoke.json "$PUBLIC_KEYFILE"
+if SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE" ./restored.sops 2>/dev/null; then echo "Should refuse the key alice has seen revoked."; exit 1; fi
+if [ -f ./restored.sops ]; then echo "Should not write the refused file."; exit 1; fi
+
+## Should refuse to add the revoked key back
+
+cp ./restored.json "$PUBLIC_KEYFILE"
+SAGGY_KEY_FILE=./alice.key $SAGGY keys remove carol
+if $SAGGY keys add carol "$(sed -n "s/^# public key: //p" ./carol.key)" 2>/dev/null; then echo "Should refuse to add the revoked key again."; exit 1; fi
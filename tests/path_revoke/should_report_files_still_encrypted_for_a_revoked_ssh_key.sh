@@ -0,0 +1,24 @@
+#!/bin/bash
+
+## Setup
+
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+PRIVATE_KEYFILE="./secrets/age.key"
+SSH_KEY="./id_ed25519"
+
+echo "test content" > ./plaintext
+ssh-keygen -q -t ed25519 -N "" -C "leaver@example" -f "$SSH_KEY"
+SAGGY_KEYNAME=stayer $SAGGY keygen
+STAYER_PUBLIC_KEY="$(sed -n "s/^# public key: //p" "$PRIVATE_KEYFILE")"
+
+# The SSH key is recorded with its comment, as it would be if the file were edited by hand
+echo "{\"stayer\": \"$STAYER_PUBLIC_KEY\", \"leaver\": \"$(cat "$SSH_KEY.pub")\"}" > "$PUBLIC_KEYFILE"
+
+# A file this host cannot decrypt, so cannot re-encrypt without the revoked key
+echo "{\"leaver\": \"$(cat "$SSH_KEY.pub")\"}" > ./leaver-only.json
+SAGGY_PUBLIC_KEYS_FILE=./leaver-only.json $SAGGY encrypt ./plaintext ./unreadable.sops
+
+## Should report the file as still encrypted for the revoked key
+
+if $SAGGY revoke leaver ./unreadable.sops > ./output 2>/dev/null; then echo "Should fail while a file is still encrypted for the revoked key."; exit 1; fi
+if ! grep -q "still readable by leaver ./unreadable.sops" ./output; then echo "Should report the file as still readable."; exit 1; fi
@@ -0,0 +1,40 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_DIR="./testdir"
+ENCRYPTED_DIR="./testdir.sops"
+SECRETS_DIR="./secrets"
+PUBLIC_KEYFILE="$SECRETS_DIR/public-age-keys.json"
+PRIVATE_KEYFILE="$SECRETS_DIR/age.key"
+
+mkdir -p "$PLAINTEXT_DIR"
+echo "file one" > "$PLAINTEXT_DIR/one"
+echo "file two" > "$PLAINTEXT_DIR/two"
+
+SAGGY_KEYNAME=leaver $SAGGY keygen
+cp "$PRIVATE_KEYFILE" "$SECRETS_DIR/leaver.key"
+LEAVER_PUBLIC_KEY="$(sed -n "s/^# public key: //p" "$PRIVATE_KEYFILE")"
+
+rm -f "$PRIVATE_KEYFILE"
+SAGGY_KEYNAME=stayer $SAGGY keygen
+
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+
+## Should revoke a key and re-encrypt without it
+
+$SAGGY revoke leaver "$ENCRYPTED_DIR" > ./output
+
+if grep -q "leaver" "$PUBLIC_KEYFILE"; then echo "Should remove the key from the public keys file."; exit 1; fi
+if grep -rq "$LEAVER_PUBLIC_KEY" "$ENCRYPTED_DIR"; then echo "Should remove the key from the encrypted files."; exit 1; fi
+if grep -q "still readable" ./output; then echo "Should not report any files as still readable."; exit 1; fi
+
+if SAGGY_KEY_FILE="$SECRETS_DIR/leaver.key" $SAGGY decrypt "$ENCRYPTED_DIR" ./leaver_decrypted; then echo "The revoked key should not be able to decrypt."; exit 1; fi
+
+$SAGGY decrypt "$ENCRYPTED_DIR" ./decrypted
+if ! diff -r "$PLAINTEXT_DIR" ./decrypted; then echo "The remaining key should be able to decrypt."; exit 1; fi
+
+## Should refuse to revoke the last key
+
+if $SAGGY revoke stayer "$ENCRYPTED_DIR"; then echo "Should refuse to leave no recipients."; exit 1; fi
+if ! grep -q "stayer" "$PUBLIC_KEYFILE"; then echo "Should keep the last key in the public keys file."; exit 1; fi
@@ -0,0 +1,38 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./plaintext"
+ENCRYPTED_FILE="./plaintext.sops"
+
+echo "test content" > "$PLAINTEXT_FILE"
+SAGGY_KEYNAME=alice SAGGY_KEY_FILE=./alice.key $SAGGY keygen
+SAGGY_KEYNAME=bob SAGGY_KEY_FILE=./bob.key $SAGGY keygen
+SAGGY_KEY_FILE=./alice.key $SAGGY keys endorse bob
+SAGGY_KEY_FILE=./bob.key $SAGGY keys endorse alice
+SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE"
+
+## Should vouch for the new key with the old one
+
+SAGGY_KEYNAME=alice SAGGY_KEY_FILE=./alice.key $SAGGY rotate "$ENCRYPTED_FILE" 2>./rotate_output
+if grep -q "needs endorsing again" ./rotate_output; then echo "Should not need the rotated key endorsing again."; exit 1; fi
+if ! $SAGGY keys show alice | grep -q "rotated from: "; then echo "Should show the key it was rotated from."; exit 1; fi
+
+## Should still trust the rotated key, and the keys it endorsed
+
+rm "$ENCRYPTED_FILE"
+SAGGY_KEY_FILE=./bob.key $SAGGY encrypt "$PLAINTEXT_FILE"
+if [ ! -f "$ENCRYPTED_FILE" ]; then echo "Should trust the rotated key from another host."; exit 1; fi
+rm "$ENCRYPTED_FILE"
+SAGGY_KEY_FILE=./alice.key $SAGGY encrypt "$PLAINTEXT_FILE"
+if [ ! -f "$ENCRYPTED_FILE" ]; then echo "Should still trust the keys the rotated key endorsed."; exit 1; fi
+
+## Should say when the new key needs endorsing again
+
+CAROL_KEYS="./carol-keys.json"
+export SAGGY_REQUIRE_ENDORSEMENTS=true
+SAGGY_KEYNAME=carol SAGGY_KEY_FILE=./carol.key SAGGY_PUBLIC_KEYS_FILE="$CAROL_KEYS" $SAGGY keygen
+echo "{\"carol\": \"$(sed -n "s/^# public key: //p" ./carol.key)\"}" > "$CAROL_KEYS"
+SAGGY_KEY_FILE=./carol.key SAGGY_PUBLIC_KEYS_FILE="$CAROL_KEYS" $SAGGY encrypt "$PLAINTEXT_FILE" ./carol.sops
+SAGGY_KEYNAME=carol SAGGY_KEY_FILE=./carol.key SAGGY_PUBLIC_KEYS_FILE="$CAROL_KEYS" $SAGGY rotate ./carol.sops 2>./rotate_output
+if ! grep -q "needs endorsing again" ./rotate_output; then echo "Should say the new key needs endorsing again."; exit 1; fi
@@ -0,0 +1,43 @@
+#!/bin/bash
+
+## Setup
+
+export SAGGY_KEYNAME=host
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+PRIVATE_KEYFILE="./secrets/age.key"
+OLD_PRIVATE_KEYFILE="./old.key"
+
+echo "file one" > ./one
+echo "file two" > ./two
+
+$SAGGY keygen
+$SAGGY encrypt ./one ./one.sops
+$SAGGY encrypt ./two ./two.sops
+cp "$PRIVATE_KEYFILE" "$OLD_PRIVATE_KEYFILE"
+
+# Leave things as a rotation that failed partway would: the new key recorded, and only one target encrypted for it
+SAGGY_KEY_FILE="$PRIVATE_KEYFILE.new" $SAGGY keygen
+NEW_PUBLIC_KEY="$(sed -n "s/^# public key: //p" "$PRIVATE_KEYFILE.new")"
+$SAGGY encrypt ./one ./one.sops
+
+## Should resume with the leftover new key, decrypting with it alongside the old one
+
+$SAGGY rotate ./one.sops ./two.sops 2>./rotate_output
+if ! grep -q "Resuming with the new key" ./rotate_output; then echo "Should say it is resuming."; exit 1; fi
+if [ -f "$PRIVATE_KEYFILE.new" ]; then echo "Should not leave the new key alongside the old one."; exit 1; fi
+if [ "$(sed -n "s/^# public key: //p" "$PRIVATE_KEYFILE")" != "$NEW_PUBLIC_KEY" ]; then echo "Should use the leftover new key."; exit 1; fi
+if ! grep -q "$NEW_PUBLIC_KEY" "$PUBLIC_KEYFILE"; then echo "Should record the new public key."; exit 1; fi
+
+## Should leave every target readable by the new key only
+
+$SAGGY decrypt ./one.sops ./one_decrypted
+$SAGGY decrypt ./two.sops ./two_decrypted
+if ! diff ./one ./one_decrypted; then echo "Should decrypt the first target with the new key."; exit 1; fi
+if ! diff ./two ./two_decrypted; then echo "Should decrypt the second target with the new key."; exit 1; fi
+if SAGGY_KEY_FILE="$OLD_PRIVATE_KEYFILE" $SAGGY decrypt ./two.sops ./two_old 2>/dev/null; then echo "Should not decrypt with the old key."; exit 1; fi
+
+## Should say how to recover from a leftover new key that cannot be read
+
+echo "not a key" > "$PRIVATE_KEYFILE.new"
+if $SAGGY rotate ./one.sops 2>./rotate_output; then echo "Should refuse the unreadable leftover key."; exit 1; fi
+if ! grep -q "remove it to start again" ./rotate_output; then echo "Should say how to recover."; exit 1; fi
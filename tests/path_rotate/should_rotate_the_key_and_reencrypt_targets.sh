@@ -0,0 +1,46 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./testfile.plaintext"
+ENCRYPTED_FILE="./testfile.sops"
+PLAINTEXT_DIR="./testdir"
+ENCRYPTED_DIR="./testdir.sops"
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+PRIVATE_KEYFILE="./secrets/age.key"
+OLD_PRIVATE_KEYFILE="./old.key"
+
+mkdir -p "$PLAINTEXT_DIR/nested"
+
+echo "test content" > "$PLAINTEXT_FILE"
+echo "file one" > "$PLAINTEXT_DIR/one"
+echo "file two" > "$PLAINTEXT_DIR/nested/two"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+
+OLD_PUBLIC_KEY="$(sed -n "s/^# public key: //p" "$PRIVATE_KEYFILE")"
+cp "$PRIVATE_KEYFILE" "$OLD_PRIVATE_KEYFILE"
+
+## Should rotate the key and re-encrypt the targets
+
+$SAGGY rotate "$ENCRYPTED_FILE" "$ENCRYPTED_DIR"
+
+NEW_PUBLIC_KEY="$(sed -n "s/^# public key: //p" "$PRIVATE_KEYFILE")"
+
+if [ "$OLD_PUBLIC_KEY" == "$NEW_PUBLIC_KEY" ]; then echo "Should replace the private key."; exit 1; fi
+if [ -f "$PRIVATE_KEYFILE.new" ]; then echo "Should not leave the new key alongside the old one."; exit 1; fi
+if $SAGGY keys list | grep -q "$OLD_PUBLIC_KEY"; then echo "Should remove the old public key."; exit 1; fi
+if ! grep -A3 '"revoked"' "$PUBLIC_KEYFILE" | grep -q "$OLD_PUBLIC_KEY"; then echo "Should record the old public key as rotated away."; exit 1; fi
+if ! grep -q "$NEW_PUBLIC_KEY" "$PUBLIC_KEYFILE"; then echo "Should add the new public key."; exit 1; fi
+
+# The new key can decrypt everything
+$SAGGY decrypt "$ENCRYPTED_FILE" ./decrypted_file
+$SAGGY decrypt "$ENCRYPTED_DIR" ./decrypted_dir
+if ! diff "$PLAINTEXT_FILE" ./decrypted_file; then echo "Should decrypt the file with the new key."; exit 1; fi
+if ! diff -r "$PLAINTEXT_DIR" ./decrypted_dir; then echo "Should decrypt the folder with the new key."; exit 1; fi
+
+# The old key can decrypt nothing
+if SAGGY_KEY_FILE="$OLD_PRIVATE_KEYFILE" $SAGGY decrypt "$ENCRYPTED_FILE" ./old_decrypted_file; then echo "Should not decrypt the file with the old key."; exit 1; fi
+if SAGGY_KEY_FILE="$OLD_PRIVATE_KEYFILE" $SAGGY decrypt "$ENCRYPTED_DIR" ./old_decrypted_dir; then echo "Should not decrypt the folder with the old key."; exit 1; fi
@@ -0,0 +1,56 @@
+#!/bin/bash
+
+## Setup
+
+cat > ./.saggy.yaml <<'YAML'
+groups:
+  ops: [alice]
+  ci: [robot]
+rules:
+  - path: prod/**
+    recipients: [ops, ci]
+  - path: dev/**
+YAML
+
+mkdir -p ./prod/app ./dev
+echo "password: prod" > ./prod/db.yaml
+echo "password: app" > ./prod/app/config.yaml
+echo "password: dev" > ./dev/db.yaml
+
+for NAME in alice robot carol; do
+    SAGGY_KEYNAME=$NAME SAGGY_KEY_FILE="./secrets/$NAME.key" $SAGGY keygen
+done
+
+## Should encrypt files and folders under prod only for ops and ci
+
+$SAGGY encrypt ./prod/db.yaml
+$SAGGY encrypt ./prod/app
+for NAME in alice robot; do
+    SAGGY_KEY_FILE="./secrets/$NAME.key" $SAGGY decrypt ./prod/db.sops.yaml "./prod-$NAME.yaml"
+    if ! diff -q ./prod/db.yaml "./prod-$NAME.yaml" >/dev/null; then echo "Should decrypt prod with $NAME's key."; exit 1; fi
+done
+if SAGGY_KEY_FILE="./secrets/carol.key" $SAGGY decrypt ./prod/db.sops.yaml ./prod-carol.yaml 2>/dev/null; then echo "Should not encrypt prod for carol."; exit 1; fi
+if SAGGY_KEY_FILE="./secrets/carol.key" $SAGGY decrypt ./prod/app.sops ./app-carol 2>/dev/null; then echo "Should not encrypt the prod folder for carol."; exit 1; fi
+
+## Should encrypt files under dev for everyone
+
+$SAGGY encrypt ./dev/db.yaml
+SAGGY_KEY_FILE="./secrets/carol.key" $SAGGY decrypt ./dev/db.sops.yaml ./dev-carol.yaml
+if ! diff -q ./dev/db.yaml ./dev-carol.yaml >/dev/null; then echo "Should encrypt dev for carol."; exit 1; fi
+
+## Should pass the check when every file matches its rule
+
+$SAGGY check
+
+## Should flag a file whose recipients do not match its rule
+
+echo "{}" > ./no-rules.yaml
+SAGGY_CONFIG=./no-rules.yaml $SAGGY encrypt ./prod/db.yaml ./prod/extra.sops.yaml
+if OUTPUT=$($SAGGY check); then echo "Should fail the check."; exit 1; fi
+if ! echo "$OUTPUT" | grep -q "mismatched prod/extra.sops.yaml"; then echo "Should name the mismatched file."; exit 1; fi
+if ! echo "$OUTPUT" | grep -q -- "- carol"; then echo "Should name the unexpected recipient."; exit 1; fi
+
+## Should bring the file in line with its rule with updatekeys
+
+SAGGY_KEY_FILE="./secrets/alice.key" $SAGGY updatekeys ./prod/extra.sops.yaml
+$SAGGY check
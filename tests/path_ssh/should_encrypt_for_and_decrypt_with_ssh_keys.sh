@@ -0,0 +1,37 @@
+#!/bin/bash
+
+## Setup
+
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+ED25519_KEY="./id_ed25519"
+RSA_KEY="./id_rsa"
+ENCRYPTED_FILE="./testfile.sops.yaml"
+PLAINTEXT_FILE="./testfile.yaml"
+DECRYPTED_FILE="./testfile.decrypted.yaml"
+
+printf 'password: hunter2\n' > "$PLAINTEXT_FILE"
+
+ssh-keygen -q -t ed25519 -N "" -C "alice@example" -f "$ED25519_KEY"
+ssh-keygen -q -t rsa -b 2048 -N "" -f "$RSA_KEY"
+
+## Should import SSH public keys rather than generating new keys
+
+SAGGY_KEYNAME=alice $SAGGY keygen --ssh "$ED25519_KEY.pub"
+SAGGY_KEYNAME=bob $SAGGY keygen --ssh "$RSA_KEY"
+if ! grep -q "ssh-ed25519 " "$PUBLIC_KEYFILE"; then echo "Should register the ed25519 key."; exit 1; fi
+if ! grep -q "ssh-rsa " "$PUBLIC_KEYFILE"; then echo "Should register the rsa key."; exit 1; fi
+if grep -q "alice@example" "$PUBLIC_KEYFILE"; then echo "Should drop the comment from the public key."; exit 1; fi
+if [ -f "./secrets/age.key" ]; then echo "Should not write a private key."; exit 1; fi
+
+## Should encrypt for every SSH key
+
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+
+## Should decrypt with either SSH private key
+
+SAGGY_KEY_FILE="$ED25519_KEY" $SAGGY decrypt "$ENCRYPTED_FILE" "$DECRYPTED_FILE"
+if ! diff "$PLAINTEXT_FILE" "$DECRYPTED_FILE"; then echo "Should decrypt with the ed25519 key."; exit 1; fi
+
+rm "$DECRYPTED_FILE"
+SAGGY_KEY_FILE="$RSA_KEY" $SAGGY decrypt "$ENCRYPTED_FILE" "$DECRYPTED_FILE"
+if ! diff "$PLAINTEXT_FILE" "$DECRYPTED_FILE"; then echo "Should decrypt with the rsa key."; exit 1; fi
@@ -0,0 +1,38 @@
+#!/bin/bash
+
+## Setup
+
+PUBLIC_KEYFILE="./secrets/public-age-keys.json"
+ED25519_KEY="./id_ed25519"
+PLAINTEXT_FILE="./mine.yaml"
+SHARED_FILE="./shared.yaml"
+
+printf 'password: hunter2\n' > "$PLAINTEXT_FILE"
+printf 'password: hunter3\n' > "$SHARED_FILE"
+
+ssh-keygen -q -t ed25519 -N "" -f "$ED25519_KEY"
+SAGGY_KEYNAME=alice $SAGGY keygen --ssh "$ED25519_KEY.pub"
+SAGGY_KEYNAME=carol SAGGY_KEY_FILE=./carol.key $SAGGY keygen
+SAGGY_KEY_FILE=./carol.key $SAGGY keys endorse alice
+
+cat > .saggy.yaml <<'YAML'
+rules:
+  - path: mine.yaml
+    recipients: [alice]
+YAML
+
+## Should encrypt for its own SSH key once the file is signed
+
+SAGGY_KEY_FILE="$ED25519_KEY" $SAGGY encrypt "$PLAINTEXT_FILE"
+if [ ! -f "./mine.sops.yaml" ]; then echo "Should trust this host's own SSH key."; exit 1; fi
+SAGGY_KEY_FILE="$ED25519_KEY" $SAGGY decrypt "./mine.sops.yaml" ./decrypted.yaml
+if ! diff -q ./decrypted.yaml "$PLAINTEXT_FILE" >/dev/null; then echo "Should decrypt what it encrypted."; exit 1; fi
+
+## Should not trust keys through an SSH key, which cannot endorse
+
+if SAGGY_KEY_FILE="$ED25519_KEY" $SAGGY encrypt "$SHARED_FILE" 2>/dev/null; then echo "Should refuse the key it cannot verify."; exit 1; fi
+
+## Should refuse to endorse with an SSH key, saying why
+
+if SAGGY_KEY_FILE="$ED25519_KEY" $SAGGY keys endorse carol 2>./endorse_error; then echo "Should refuse to endorse with an SSH key."; exit 1; fi
+if ! grep -q "SSH keys cannot endorse" ./endorse_error; then echo "Should say that SSH keys cannot endorse."; exit 1; fi
@@ -0,0 +1,49 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_FILE="./testfile.plaintext"
+ENCRYPTED_FILE="./testfile.sops"
+SECRETS_DIR="./secrets"
+PRIVATE_KEYFILE="$SECRETS_DIR/age.key"
+
+echo "test content" > "$PLAINTEXT_FILE"
+
+SAGGY_KEYNAME=alpha $SAGGY keygen
+cp "$PRIVATE_KEYFILE" "$SECRETS_DIR/alpha.key"
+
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+ENCRYPTED_VALUE="$(grep -o '"data": "ENC\[[^"]*"' "$ENCRYPTED_FILE")"
+
+# A teammate adds their key
+rm -f "$PRIVATE_KEYFILE"
+SAGGY_KEYNAME=beta $SAGGY keygen
+cp "$PRIVATE_KEYFILE" "$SECRETS_DIR/beta.key"
+
+if SAGGY_KEY_FILE="$SECRETS_DIR/beta.key" $SAGGY decrypt "$ENCRYPTED_FILE" ./decrypted_beta; then echo "Beta should not be able to decrypt yet."; exit 1; fi
+
+## Should report the change without making it in dry run mode
+
+cp "$ENCRYPTED_FILE" ./before
+SAGGY_KEY_FILE="$SECRETS_DIR/alpha.key" $SAGGY updatekeys --dry-run "$ENCRYPTED_FILE" > ./dry_run_output
+if ! grep -q "would update" ./dry_run_output; then echo "Should report the file would be updated."; exit 1; fi
+if ! grep -q "+ beta" ./dry_run_output; then echo "Should report beta would be added."; exit 1; fi
+if ! cmp -s ./before "$ENCRYPTED_FILE"; then echo "Should not change the file in dry run mode."; exit 1; fi
+
+## Should add the new recipient
+
+SAGGY_KEY_FILE="$SECRETS_DIR/alpha.key" $SAGGY updatekeys "$ENCRYPTED_FILE" > ./output
+if ! grep -q "^updated" ./output; then echo "Should report the file was updated."; exit 1; fi
+
+SAGGY_KEY_FILE="$SECRETS_DIR/beta.key" $SAGGY decrypt "$ENCRYPTED_FILE" ./decrypted_beta
+if ! diff ./decrypted_beta "$PLAINTEXT_FILE"; then echo "Beta should be able to decrypt."; exit 1; fi
+
+SAGGY_KEY_FILE="$SECRETS_DIR/alpha.key" $SAGGY decrypt "$ENCRYPTED_FILE" ./decrypted_alpha
+if ! diff ./decrypted_alpha "$PLAINTEXT_FILE"; then echo "Alpha should still be able to decrypt."; exit 1; fi
+
+if ! grep -qF "$ENCRYPTED_VALUE" "$ENCRYPTED_FILE"; then echo "Should not re-encrypt the values."; exit 1; fi
+
+## Should leave an up to date file alone
+
+SAGGY_KEY_FILE="$SECRETS_DIR/alpha.key" $SAGGY updatekeys "$ENCRYPTED_FILE" > ./second_output
+if ! grep -q "^unchanged" ./second_output; then echo "Should report the file as unchanged."; exit 1; fi
@@ -27,7 +27,7 @@ $SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
 $SAGGY with "$ENCRYPTED_DIR" -w -- cp -r "$REPLACEMENT_PLAINTEXT_DIR"/* {}
 
 # Use with to extract the encrypted content
-$SAGGY with "$ENCRYPTED_DIR" -- cp -r {}/* "$DECRYPTED_DIR"
+$SAGGY with "$ENCRYPTED_DIR" --shell -- cp -r {}/* "$DECRYPTED_DIR"
 
 # Verify the content was written
 if ! diff -r "$REPLACEMENT_PLAINTEXT_DIR" "$DECRYPTED_DIR"; then echo "Should contain the new content."; exit 1; fi
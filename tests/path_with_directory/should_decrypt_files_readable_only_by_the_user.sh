@@ -0,0 +1,33 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_DIR="./testdir"
+ENCRYPTED_DIR="./testdir.sops"
+CONFIGURED_TMPDIR="$(pwd)/configured_tmp"
+
+mkdir -p "$PLAINTEXT_DIR/nested" "$CONFIGURED_TMPDIR"
+echo "file one" > "$PLAINTEXT_DIR/one"
+echo "file two" > "$PLAINTEXT_DIR/nested/two"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+$SAGGY encrypt "$PLAINTEXT_DIR/one" ./one.sops
+
+## Should only allow the owner to read the files decrypted for with
+
+SAGGY_TMPDIR="$CONFIGURED_TMPDIR" $SAGGY with "$ENCRYPTED_DIR" --allow-disk -- sh -c 'stat -c %a {}/one {}/nested/two' > ./with_modes
+if [ "$(sort -u ./with_modes)" != "600" ]; then echo "Should create the decrypted files for with with 0600."; exit 1; fi
+
+## Should only allow the owner to read a decrypted folder
+
+$SAGGY decrypt "$ENCRYPTED_DIR" ./decrypted_dir
+if [ "$(stat -c %a ./decrypted_dir/one ./decrypted_dir/nested/two | sort -u)" != "600" ]; then echo "Should create decrypted files with 0600."; exit 1; fi
+if [ "$(stat -c %a ./decrypted_dir ./decrypted_dir/nested | sort -u)" != "700" ]; then echo "Should create decrypted folders with 0700."; exit 1; fi
+
+## Should only allow the owner to read a decrypted file
+
+$SAGGY decrypt ./one.sops ./one_decrypted
+if [ "$(stat -c %a ./one_decrypted)" != "600" ]; then echo "Should create a decrypted file with 0600."; exit 1; fi
+$SAGGY decrypt - ./piped_decrypted < ./one.sops
+if [ "$(stat -c %a ./piped_decrypted)" != "600" ]; then echo "Should create a piped decrypted file with 0600."; exit 1; fi
@@ -0,0 +1,25 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_DIR="./testdir.sops"
+PLAINTEXT_DIR="./plaintext"
+
+mkdir -p "$PLAINTEXT_DIR"
+echo "test content 1" > "$PLAINTEXT_DIR/file1.txt"
+echo '{"key": "value"}' > "$PLAINTEXT_DIR/file2.json"
+echo "test content 3" > "$PLAINTEXT_DIR/file3.txt"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+BEFORE="$(cd "$ENCRYPTED_DIR" && find . -type f | sort | xargs sha256sum)"
+
+## Should leave the encrypted folder untouched when one of the changed files cannot be encrypted
+
+# file1.txt is encrypted before file2.json, which is no longer valid json, is reached
+if $SAGGY with "$ENCRYPTED_DIR" -w --shell -- 'echo "replacement content" > {}/file1.txt; echo "not json" > {}/file2.json; rm {}/file3.txt'; then echo "Should fail to write back invalid json."; exit 1; fi
+
+AFTER="$(cd "$ENCRYPTED_DIR" && find . -type f | sort | xargs sha256sum)"
+if [ "$BEFORE" != "$AFTER" ]; then echo "Should leave every encrypted file as it was."; exit 1; fi
+
+if [ "$(ls -A . | grep -c sops)" != "1" ]; then echo "Should not leave a staging folder behind."; ls -A .; exit 1; fi
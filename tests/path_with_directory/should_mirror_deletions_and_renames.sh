@@ -0,0 +1,36 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_DIR="./testdir.sops"
+PLAINTEXT_DIR="./plaintext"
+STDERR_FILE="./.stderr"
+
+mkdir -p "$PLAINTEXT_DIR/nested"
+
+echo "test content 1" > "$PLAINTEXT_DIR/file1.txt"
+echo "test content 2" > "$PLAINTEXT_DIR/file2.txt"
+echo "test content 3" > "$PLAINTEXT_DIR/nested/file3.txt"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
+cp "$ENCRYPTED_DIR/file1.sops.txt" ./file1.sops.txt.copy
+
+## Should mirror deletions and renames made by the command
+
+$SAGGY with "$ENCRYPTED_DIR" -w --shell -- 'rm {}/nested/file3.txt && mv {}/file2.txt {}/renamed.txt' 2> "$STDERR_FILE"
+
+if [ -e "$ENCRYPTED_DIR/nested/file3.sops.txt" ]; then echo "Should remove the deleted file."; exit 1; fi
+if [ -e "$ENCRYPTED_DIR/nested" ]; then echo "Should remove the emptied folder."; exit 1; fi
+if [ -e "$ENCRYPTED_DIR/file2.sops.txt" ]; then echo "Should remove the renamed file."; exit 1; fi
+if [ ! -f "$ENCRYPTED_DIR/renamed.sops.txt" ]; then echo "Should add the renamed file."; exit 1; fi
+
+## Should preserve untouched files
+
+if ! cmp -s "$ENCRYPTED_DIR/file1.sops.txt" ./file1.sops.txt.copy; then echo "Should leave the untouched file alone."; exit 1; fi
+
+## Should print a summary
+
+if ! grep -q "^added .*renamed.sops.txt" "$STDERR_FILE"; then echo "Should report the added file."; exit 1; fi
+if ! grep -q "^removed .*file2.sops.txt" "$STDERR_FILE"; then echo "Should report the removed file."; exit 1; fi
+if ! grep -q "^removed .*file3.sops.txt" "$STDERR_FILE"; then echo "Should report the removed nested file."; exit 1; fi
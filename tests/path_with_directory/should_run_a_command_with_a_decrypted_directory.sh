@@ -19,7 +19,7 @@ $SAGGY encrypt "$PLAINTEXT_DIR" "$ENCRYPTED_DIR"
 ## Should be able to run a command with a decrypted directory
 
 # Use with to make a copy of the decrypted directory
-$SAGGY with "$ENCRYPTED_DIR" -- cp -r {}/* "$DECRYPTED_DIR"
+$SAGGY with "$ENCRYPTED_DIR" --shell -- cp -r {}/* "$DECRYPTED_DIR"
 
 # Verify
 if [ ! -d "$DECRYPTED_DIR" ]; then echo "Should create a decrypted directory."; exit 1; fi
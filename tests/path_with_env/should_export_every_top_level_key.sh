@@ -0,0 +1,45 @@
+#!/bin/bash
+
+## Setup
+
+PLAINTEXT_YAML="./config.yaml"
+ENCRYPTED_YAML="./config.sops.yaml"
+PLAINTEXT_ENV="./config.env"
+ENCRYPTED_ENV="./config.sops.env"
+INVALID_YAML="./invalid.yaml"
+ENCRYPTED_INVALID_YAML="./invalid.sops.yaml"
+
+cat > "$PLAINTEXT_YAML" <<YAML
+API_TOKEN: abc123
+DB_PORT: 5432
+YAML
+cat > "$PLAINTEXT_ENV" <<DOTENV
+API_TOKEN=def456
+DOTENV
+cat > "$INVALID_YAML" <<YAML
+not-a-valid-name: value
+YAML
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_YAML" "$ENCRYPTED_YAML"
+$SAGGY encrypt "$PLAINTEXT_ENV" "$ENCRYPTED_ENV"
+$SAGGY encrypt "$INVALID_YAML" "$ENCRYPTED_INVALID_YAML"
+
+## Should export every top level key of a yaml file
+
+$SAGGY with -e "$ENCRYPTED_YAML" -- sh -c 'echo "$API_TOKEN:$DB_PORT"' > ./yaml_output
+if [ "$(cat ./yaml_output)" != "abc123:5432" ]; then echo "Should export every top level key."; exit 1; fi
+
+## Should export every key of a dotenv file
+
+$SAGGY with -e "$ENCRYPTED_ENV" -- sh -c 'echo "$API_TOKEN"' > ./env_output
+if [ "$(cat ./env_output)" != "def456" ]; then echo "Should export every key of a dotenv file."; exit 1; fi
+
+## Should prefix the variable names
+
+$SAGGY with -e "$ENCRYPTED_YAML" --prefix APP_ -- sh -c 'echo "$APP_API_TOKEN"' > ./prefix_output
+if [ "$(cat ./prefix_output)" != "abc123" ]; then echo "Should prefix the variable names."; exit 1; fi
+
+## Should reject keys which are not valid variable names
+
+if $SAGGY with -e "$ENCRYPTED_INVALID_YAML" -- true; then echo "Should reject invalid variable names."; exit 1; fi
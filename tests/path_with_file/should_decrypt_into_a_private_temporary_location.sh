@@ -0,0 +1,34 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_FILE="./testfile.sops"
+PLAINTEXT_FILE="./testfile.plaintext"
+CONFIGURED_TMPDIR="$(pwd)/configured_tmp"
+OUTPUT_FILE="./output"
+
+mkdir -p "$CONFIGURED_TMPDIR"
+echo "test content" > "$PLAINTEXT_FILE"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+
+## Should use the configured temporary directory
+
+SAGGY_TMPDIR="$CONFIGURED_TMPDIR" $SAGGY with "$ENCRYPTED_FILE" --allow-disk -- dirname {} > "$OUTPUT_FILE"
+if [ "$(cat "$OUTPUT_FILE")" != "$CONFIGURED_TMPDIR" ]; then echo "Should use SAGGY_TMPDIR."; exit 1; fi
+
+## Should only allow the owner to read the decrypted file
+
+SAGGY_TMPDIR="$CONFIGURED_TMPDIR" $SAGGY with "$ENCRYPTED_FILE" --allow-disk -- stat -c %a {} > "$OUTPUT_FILE"
+if [ "$(cat "$OUTPUT_FILE")" != "600" ]; then echo "Should create the decrypted file with 0600."; exit 1; fi
+
+## Should clean up after itself
+
+if [ -n "$(ls -A "$CONFIGURED_TMPDIR")" ]; then echo "Should remove the decrypted file."; exit 1; fi
+
+## Should refuse a configured temporary directory on disk without --allow-disk
+
+if SAGGY_TMPDIR="$CONFIGURED_TMPDIR" $SAGGY with "$ENCRYPTED_FILE" -- true 2>/dev/null; then echo "Should refuse a disk backed SAGGY_TMPDIR."; exit 1; fi
+echo "tmpDir: configured_tmp" > ./.saggy.yaml
+if $SAGGY with "$ENCRYPTED_FILE" -- true 2>/dev/null; then echo "Should refuse a disk backed tmpDir from the config file."; exit 1; fi
@@ -0,0 +1,29 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_FILE="./testfile.sops"
+PLAINTEXT_FILE="./testfile.plaintext"
+OUTPUT_FILE="./output"
+
+echo "test content" > "$PLAINTEXT_FILE"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+
+## Should substitute a FIFO rather than a regular file
+
+$SAGGY with "$ENCRYPTED_FILE" --fifo -- sh -c 'test -p "$1" && cat "$1"' sh {} > "$OUTPUT_FILE"
+if [ $? -ne 0 ]; then echo "Should substitute a FIFO."; exit 1; fi
+
+## Should deliver the decrypted content through the FIFO
+
+if ! diff "$PLAINTEXT_FILE" "$OUTPUT_FILE"; then echo "Should deliver the decrypted content."; exit 1; fi
+
+## Should fail when the command never opens the FIFO
+
+if $SAGGY with "$ENCRYPTED_FILE" --fifo -- true; then echo "Should fail when the FIFO is never opened."; exit 1; fi
+
+## Should fail when the command does not open the FIFO in time
+
+if $SAGGY with "$ENCRYPTED_FILE" --fifo --fifo-timeout 100ms -- sleep 1; then echo "Should time out waiting for the FIFO."; exit 1; fi
@@ -0,0 +1,31 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_FILE="./testfile.sops"
+PLAINTEXT_FILE="./testfile.plaintext"
+CONFIGURED_TMPDIR="$(pwd)/configured_tmp"
+
+mkdir -p "$CONFIGURED_TMPDIR"
+echo "test content" > "$PLAINTEXT_FILE"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+
+## Should forward the signal to the command and exit with 128+n
+
+SAGGY_TMPDIR="$CONFIGURED_TMPDIR" $SAGGY with "$ENCRYPTED_FILE" --allow-disk -- sleep 10 &
+SAGGY_PID=$!
+sleep 1
+kill -TERM "$SAGGY_PID"
+EXIT_CODE=0
+if wait "$SAGGY_PID"; then
+  EXIT_CODE=$?
+else
+  EXIT_CODE=$?
+fi
+if [ "$EXIT_CODE" -ne 143 ]; then echo "Should exit with 143 after SIGTERM, got $EXIT_CODE."; exit 1; fi
+
+## Should remove the decrypted file
+
+if [ -n "$(ls -A "$CONFIGURED_TMPDIR")" ]; then echo "Should remove the decrypted file after a signal."; exit 1; fi
@@ -0,0 +1,32 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_FILE="./testfile.sops"
+ENCRYPTED_COPY="./testfile.sops.copy"
+DECRYPTED_FILE="./testfile.decrypted"
+PLAINTEXT_FILE="./testfile.plaintext"
+REPLACEMENT_PLAINTEXT_FILE="./new_testfile.plaintext"
+
+echo "test content" > "$PLAINTEXT_FILE"
+echo "new content" > "$REPLACEMENT_PLAINTEXT_FILE"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+cp "$ENCRYPTED_FILE" "$ENCRYPTED_COPY"
+
+## Should not re-encrypt when the content is unchanged
+
+$SAGGY with "$ENCRYPTED_FILE" -w -- cat {}
+if ! cmp -s "$ENCRYPTED_FILE" "$ENCRYPTED_COPY"; then echo "Should leave an unchanged secret untouched."; exit 1; fi
+
+## Should not write back when the command fails
+
+if $SAGGY with "$ENCRYPTED_FILE" -w -- sh -c 'cp "$1" "$2"; exit 4' sh "$REPLACEMENT_PLAINTEXT_FILE" {}; then echo "Should pass the failure through."; exit 1; fi
+if ! cmp -s "$ENCRYPTED_FILE" "$ENCRYPTED_COPY"; then echo "Should not write back after the command failed."; exit 1; fi
+
+## Should write back when the command succeeds
+
+$SAGGY with "$ENCRYPTED_FILE" -w -- cp "$REPLACEMENT_PLAINTEXT_FILE" {}
+$SAGGY with "$ENCRYPTED_FILE" -- cat {} > "$DECRYPTED_FILE"
+if ! diff "$REPLACEMENT_PLAINTEXT_FILE" "$DECRYPTED_FILE"; then echo "Should contain the new content."; exit 1; fi
@@ -0,0 +1,31 @@
+#!/bin/bash
+
+## Setup
+
+ENCRYPTED_FILE="./testfile.sops"
+PLAINTEXT_FILE="./testfile.plaintext"
+OUTPUT_FILE="./output"
+
+echo "test content" > "$PLAINTEXT_FILE"
+
+$SAGGY keygen
+$SAGGY encrypt "$PLAINTEXT_FILE" "$ENCRYPTED_FILE"
+
+## Should pass arguments containing spaces and quotes through untouched
+
+$SAGGY with "$ENCRYPTED_FILE" -- printf '%s|' "two words" "it's" '$HOME' "{}" > "$OUTPUT_FILE"
+if ! grep -q "^two words|it's|\$HOME|/" "$OUTPUT_FILE"; then echo "Should not interpret the arguments."; exit 1; fi
+
+## Should interpret the command with a shell when asked
+
+$SAGGY with "$ENCRYPTED_FILE" --shell -- cat {} '|' wc -l > "$OUTPUT_FILE"
+if [ "$(tr -d ' ' < "$OUTPUT_FILE")" != "1" ]; then echo "Should interpret the command with the shell."; exit 1; fi
+
+$SAGGY with "$ENCRYPTED_FILE" --shell bash -- 'echo "$BASH_VERSION"' > "$OUTPUT_FILE"
+if [ -z "$(cat "$OUTPUT_FILE")" ]; then echo "Should use the given shell."; exit 1; fi
+
+## Should not take a following flag as the shell
+
+$SAGGY with "$ENCRYPTED_FILE" --shell -w -- 'echo changed > {}'
+$SAGGY decrypt "$ENCRYPTED_FILE" ./redecrypted
+if [ "$(cat ./redecrypted)" != "changed" ]; then echo "Should keep -w after --shell."; exit 1; fi
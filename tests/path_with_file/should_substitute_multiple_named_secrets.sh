@@ -0,0 +1,31 @@
+#!/bin/bash
+
+## Setup
+
+FIRST_PLAINTEXT="./first.plaintext"
+FIRST_ENCRYPTED="./first.sops"
+SECOND_PLAINTEXT="./second.plaintext"
+SECOND_ENCRYPTED="./second.sops"
+OUTPUT_FILE="./output"
+
+echo "first content" > "$FIRST_PLAINTEXT"
+echo "second content" > "$SECOND_PLAINTEXT"
+
+$SAGGY keygen
+$SAGGY encrypt "$FIRST_PLAINTEXT" "$FIRST_ENCRYPTED"
+$SAGGY encrypt "$SECOND_PLAINTEXT" "$SECOND_ENCRYPTED"
+
+## Should substitute a custom token
+
+$SAGGY with "$FIRST_ENCRYPTED" -I @@ -- cat @@ > "$OUTPUT_FILE"
+if ! diff "$FIRST_PLAINTEXT" "$OUTPUT_FILE"; then echo "Should substitute the custom token."; exit 1; fi
+
+## Should substitute each named secret
+
+$SAGGY with --secret FIRST="$FIRST_ENCRYPTED" --secret SECOND="$SECOND_ENCRYPTED" -- cat {FIRST} {SECOND} > "$OUTPUT_FILE"
+if ! diff <(cat "$FIRST_PLAINTEXT" "$SECOND_PLAINTEXT") "$OUTPUT_FILE"; then echo "Should substitute each named secret."; exit 1; fi
+
+## Should combine the target with named secrets
+
+$SAGGY with "$FIRST_ENCRYPTED" --secret SECOND="$SECOND_ENCRYPTED" -- cat {SECOND} {} > "$OUTPUT_FILE"
+if ! diff <(cat "$SECOND_PLAINTEXT" "$FIRST_PLAINTEXT") "$OUTPUT_FILE"; then echo "Should combine the target with named secrets."; exit 1; fi
@@ -90,7 +90,8 @@ run_test() {
 
     cd "$CHILD_TEST_DIR"
 
-    if env -i "${CHILD_ENV[@]}" TMPDIR="$TEST_TEMP_DIR" bash -xeuo pipefail "$SCRIPT_DIR/$test_script" > "$RESULTS_DIR/$test_id.log" 2>&1; then
+    # Each test has its own config directory, so that what saggy records there does not carry over between tests
+    if env -i "${CHILD_ENV[@]}" TMPDIR="$TEST_TEMP_DIR" XDG_CONFIG_HOME="$CHILD_TEST_DIR/config" bash -xeuo pipefail "$SCRIPT_DIR/$test_script" > "$RESULTS_DIR/$test_id.log" 2>&1; then
         mv "$RESULTS_DIR/$test_id.log" "$RESULTS_DIR/$test_id.success"
     else
         mv "$RESULTS_DIR/$test_id.log" "$RESULTS_DIR/$test_id.failure"